@@ -0,0 +1,212 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// channelProtocol is the protocol of the streams OpenChannel opens. The
+// opening side sends the channel name, the remote answers with a status
+// byte, then both send messages:
+//
+//	4 bytes message length, big endian
+//	n bytes message
+const channelProtocol = reservedPrefix + "channel"
+
+const (
+	channelOK byte = iota
+	channelUnknown
+)
+
+// maxChannelMessage is the largest message a Channel sends or accepts.
+const maxChannelMessage = 16 << 20
+
+var (
+	errChannelUnknown = errors.New("no remote handler for channel")
+	// ErrMessageTooLarge is returned for messages over 16 MiB.
+	ErrMessageTooLarge = errors.New("channel message too large")
+)
+
+// Channel is a full-duplex message channel to the remote. Messages keep
+// their boundaries and order. Send blocks while the remote is not receiving
+// and its buffers are full, so a slow receiver slows the sender down.
+// Send and Receive may be called concurrently with each other.
+type Channel struct {
+	// Name is the name the channel was opened with.
+	Name string
+
+	s       *Stream
+	readMu  sync.Mutex
+	writeMu sync.Mutex
+}
+
+// HandleChannel registers handler for the channels the remote opens with
+// name. The channel is closed when handler returns. It panics if name is
+// empty, longer than 255 bytes or starts with "tunnel/", which is reserved.
+func (p *Peer) HandleChannel(name string, handler func(*Channel)) {
+	if err := validChannelName(name); err != nil {
+		panic(err)
+	}
+	p.channelMu.Lock()
+	defer p.channelMu.Unlock()
+	p.channelHandlers[name] = handler
+}
+
+// OpenChannel opens a channel to the handler the remote registered for name.
+func (p *Peer) OpenChannel(ctx context.Context, name string) (*Channel, error) {
+	if err := validChannelName(name); err != nil {
+		return nil, err
+	}
+	s, err := p.openStream(ctx, channelProtocol)
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		_ = s.Close()
+	})
+	status, err := requestChannel(s, name)
+	if !stop() {
+		err = ctx.Err()
+	}
+	if err == nil && status != channelOK {
+		err = errChannelUnknown
+	}
+	if err != nil {
+		_ = s.Close()
+		return nil, fmt.Errorf("open channel %s: %w", name, err)
+	}
+	return &Channel{Name: name, s: s}, nil
+}
+
+func validChannelName(name string) error {
+	if name == "" || len(name) > maxProtocolLen {
+		return fmt.Errorf("channel name must be 1-%d bytes", maxProtocolLen)
+	}
+	if strings.HasPrefix(name, reservedPrefix) {
+		return fmt.Errorf("channel name %s is reserved", name)
+	}
+	return nil
+}
+
+func requestChannel(s *Stream, name string) (byte, error) {
+	if _, err := s.Write(appendString(nil, name)); err != nil {
+		return 0, err
+	}
+	status := make([]byte, 1)
+	if _, err := io.ReadFull(s, status); err != nil {
+		return 0, err
+	}
+	return status[0], nil
+}
+
+func (p *Peer) serveChannel(s *Stream) {
+	_ = s.SetReadDeadline(time.Now().Add(streamHeaderTimeout))
+	name, err := readString(s)
+	if err != nil {
+		log.Debugf("read channel name error: %s\n", err)
+		_ = s.Close()
+		return
+	}
+	_ = s.SetReadDeadline(time.Time{})
+	p.channelMu.RLock()
+	handler := p.channelHandlers[name]
+	p.channelMu.RUnlock()
+	if handler == nil {
+		log.Debugf("no handler for channel %s\n", name)
+		_, _ = s.Write([]byte{channelUnknown})
+		_ = s.Close()
+		return
+	}
+	if _, err = s.Write([]byte{channelOK}); err != nil {
+		_ = s.Close()
+		return
+	}
+	c := &Channel{Name: name, s: s}
+	defer c.Close()
+	handler(c)
+}
+
+// Send sends msg as one message.
+func (c *Channel) Send(msg []byte) error {
+	if len(msg) > maxChannelMessage {
+		return ErrMessageTooLarge
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	b := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(msg)), uint32(len(msg)))
+	_, err := c.s.Write(append(b, msg...))
+	return err
+}
+
+// Receive returns the next message. It returns io.EOF once the remote
+// closed the channel.
+func (c *Channel) Receive() ([]byte, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	var n [4]byte
+	if _, err := io.ReadFull(c.s, n[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(n[:])
+	if size > maxChannelMessage {
+		_ = c.s.Close()
+		return nil, ErrMessageTooLarge
+	}
+	// grow with what arrives rather than trust the length up front
+	var msg bytes.Buffer
+	if _, err := io.CopyN(&msg, c.s, int64(size)); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return msg.Bytes(), nil
+}
+
+// SendJSON sends v encoded as JSON.
+func (c *Channel) SendJSON(v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.Send(b)
+}
+
+// ReceiveJSON decodes the next message, JSON, into v.
+func (c *Channel) ReceiveJSON(v any) error {
+	b, err := c.Receive()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// SetReadDeadline bounds the wait of Receive, like net.Conn's.
+func (c *Channel) SetReadDeadline(t time.Time) error {
+	return c.s.SetReadDeadline(t)
+}
+
+// CloseSend tells the remote no more messages follow, its Receive returns
+// io.EOF, while the channel still receives.
+func (c *Channel) CloseSend() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if cw, ok := c.s.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.s.Close()
+}
+
+// Close closes the channel in both directions, pending Send and Receive
+// calls return.
+func (c *Channel) Close() error {
+	return c.s.Close()
+}
@@ -0,0 +1,146 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestChannels(t *testing.T) {
+	large := make([]byte, 1<<20)
+	_, _ = rand.Read(large)
+	messages := [][]byte{[]byte("hello"), {}, large, []byte("world")}
+
+	for _, pp := range peerPairs {
+		t.Run(pp.name, func(t *testing.T) {
+			a, b := pp.pair(t)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			// echoes until the opener is done sending, then says how many
+			// messages it got
+			b.HandleChannel("count", func(c *Channel) {
+				n := 0
+				for {
+					msg, err := c.Receive()
+					if err != nil {
+						_ = c.SendJSON(map[string]int{"messages": n})
+						return
+					}
+					n++
+					if err = c.Send(msg); err != nil {
+						return
+					}
+				}
+			})
+
+			c, err := a.OpenChannel(ctx, "count")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			if c.Name != "count" {
+				t.Fatalf("name %q", c.Name)
+			}
+			go func() {
+				for _, msg := range messages {
+					if err := c.Send(msg); err != nil {
+						return
+					}
+				}
+				_ = c.CloseSend()
+			}()
+			// boundaries are kept, empty messages included
+			for i, want := range messages {
+				got, err := c.Receive()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Fatalf("message %d: %d bytes, want %d", i, len(got), len(want))
+				}
+			}
+			// the channel still receives after CloseSend
+			var count map[string]int
+			if err = c.ReceiveJSON(&count); err != nil {
+				t.Fatal(err)
+			}
+			if count["messages"] != len(messages) {
+				t.Fatalf("remote counted %v, want %d", count, len(messages))
+			}
+			if _, err = c.Receive(); !errors.Is(err, io.EOF) {
+				t.Fatalf("receive after the handler returned: %v, want %v", err, io.EOF)
+			}
+		})
+	}
+}
+
+func TestChannelNames(t *testing.T) {
+	a, b := newPeerPair(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	b.HandleChannel("known", func(*Channel) {})
+
+	if _, err := a.OpenChannel(ctx, "unknown"); !errors.Is(err, errChannelUnknown) {
+		t.Fatalf("open unknown channel: %v, want %v", err, errChannelUnknown)
+	}
+	for _, name := range []string{"", string(make([]byte, 256)), reservedPrefix + "channel", reservedPrefix} {
+		if _, err := a.OpenChannel(ctx, name); err == nil {
+			t.Fatalf("opened channel %q", name)
+		}
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("handled channel %q", name)
+				}
+			}()
+			b.HandleChannel(name, func(*Channel) {})
+		}()
+	}
+}
+
+func TestChannelMessageLimits(t *testing.T) {
+	a, b := newPeerPair(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// announce sizes the handler does not send
+	sizes := make(chan uint32)
+	b.HandleChannel("lying", func(c *Channel) {
+		hdr := binary.BigEndian.AppendUint32(nil, <-sizes)
+		_, _ = c.s.Write(append(hdr, "short"...))
+	})
+
+	c, err := a.OpenChannel(ctx, "lying")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Send(make([]byte, maxChannelMessage+1)); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("send oversized: %v, want %v", err, ErrMessageTooLarge)
+	}
+	sizes <- maxChannelMessage + 1
+	if _, err = c.Receive(); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("receive oversized: %v, want %v", err, ErrMessageTooLarge)
+	}
+
+	c, err = a.OpenChannel(ctx, "lying")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	sizes <- maxChannelMessage
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, err = c.Receive(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("receive truncated: %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	runtime.ReadMemStats(&after)
+	// an announced size is not allocated before the message arrives
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > maxChannelMessage/4 {
+		t.Fatalf("allocated %d bytes for a message of 5", alloc)
+	}
+}
@@ -0,0 +1,141 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// ntpServers are queried to estimate the local clock offset, so both peers
+// can agree on a punch start instant even when their clocks disagree.
+var ntpServers = []string{
+	"time.google.com:123",
+	"time.cloudflare.com:123",
+	"pool.ntp.org:123",
+}
+
+// seconds between the NTP epoch (1900) and the unix epoch (1970)
+const ntpEpochOffset = 2208988800
+
+const ntpTimeout = time.Second * 2
+
+// defaultPunchLead is how far ahead of its signal a peer proposes to start
+// punching. The later proposal wins, so a remote that signals late, e.g.
+// after its NTP round timed out, moves the start back itself; the lead only
+// has to cover the signal delivery and the error of both clock offsets.
+const defaultPunchLead = time.Second * 2
+
+// WithPunchLead sets how far ahead of its signal a peer proposes to start
+// punching, raise it for a signal slower than defaultPunchLead. Zero or less
+// disables the coordinated start and its NTP query, punching then starts as
+// soon as the remote's signal is read.
+func WithPunchLead(d time.Duration) Option {
+	return func(t *Tunnel) {
+		t.punchLead = d
+	}
+}
+
+// clockOffset estimates the local clock error with SNTP (RFC 4330).
+// Reference time is local time plus the returned offset.
+func clockOffset() (time.Duration, error) {
+	var err error
+	for _, server := range ntpServers {
+		var offset time.Duration
+		offset, err = sntpQuery(server)
+		if err == nil {
+			log.Debugf("clock offset %s from %s\n", offset, server)
+			return offset, nil
+		}
+		log.Debugf("ntp %s error: %v\n", server, err)
+	}
+	return 0, err
+}
+
+func sntpQuery(server string) (time.Duration, error) {
+	conn, err := net.Dial("udp4", server)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	if err = conn.SetDeadline(time.Now().Add(ntpTimeout)); err != nil {
+		return 0, err
+	}
+	// message format:
+	// 1 byte LI/VN/Mode, client mode 3 with version 4
+	// 23 bytes stratum, poll, precision, root delay/dispersion, reference id
+	// 8 bytes reference timestamp
+	// 8 bytes originate timestamp
+	// 8 bytes receive timestamp
+	// 8 bytes transmit timestamp
+	req := make([]byte, 48)
+	req[0] = 0x23
+	t1 := time.Now()
+	binary.BigEndian.PutUint64(req[40:], toNTPTime(t1))
+	if _, err = conn.Write(req); err != nil {
+		return 0, err
+	}
+	res := make([]byte, 48)
+	n, err := conn.Read(res)
+	if err != nil {
+		return 0, err
+	}
+	t4 := time.Now()
+	if n < 48 || res[0]&0x7 != 4 || res[1] == 0 {
+		return 0, fmt.Errorf("invalid ntp response")
+	}
+	if binary.BigEndian.Uint64(res[24:]) != binary.BigEndian.Uint64(req[40:]) {
+		return 0, fmt.Errorf("ntp originate timestamp not match")
+	}
+	t2 := fromNTPTime(binary.BigEndian.Uint64(res[32:]))
+	t3 := fromNTPTime(binary.BigEndian.Uint64(res[40:]))
+	return (t2.Sub(t1) + t3.Sub(t4)) / 2, nil
+}
+
+func toNTPTime(t time.Time) uint64 {
+	nsec := uint64(t.Sub(time.Unix(-ntpEpochOffset, 0)))
+	sec := nsec / uint64(time.Second)
+	frac := (nsec % uint64(time.Second)) << 32 / uint64(time.Second)
+	return sec<<32 | frac
+}
+
+func fromNTPTime(ts uint64) time.Time {
+	sec := int64(ts >> 32)
+	nsec := int64((ts & 0xffffffff) * uint64(time.Second) >> 32)
+	return time.Unix(sec-ntpEpochOffset, nsec)
+}
+
+// punchStart returns the local instant both peers start punching at.
+// Proposals are unix milliseconds of reference time and the later one wins,
+// now is the local time. If that instant already passed, the remote started
+// without us and the zero time is returned, to start immediately and overlap
+// with its punching; a zero proposal of either side means the same.
+func punchStart(local, remote int64, offset time.Duration, now time.Time) time.Time {
+	if local == 0 || remote == 0 {
+		return time.Time{}
+	}
+	start := time.UnixMilli(max(local, remote)).Add(-offset)
+	if !start.After(now) {
+		log.Debugf("punch start passed %s ago, starting now\n", now.Sub(start))
+		return time.Time{}
+	}
+	return start
+}
+
+// waitPunchStart blocks until the negotiated punch start instant.
+func waitPunchStart(ctx context.Context, at time.Time) error {
+	d := time.Until(at)
+	if d <= 0 {
+		return nil
+	}
+	log.Debugf("punch starts in %s\n", d)
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,86 @@
+package tunnel
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPunchStart(t *testing.T) {
+	ref := time.UnixMilli(1_700_000_000_000)
+	tests := []struct {
+		name string
+		// clock offsets of the peers, reference time is local time plus offset
+		offsetA, offsetB time.Duration
+		// when the peers proposed and when they read the other's signal,
+		// in reference time
+		proposeA, proposeB time.Duration
+		readA, readB       time.Duration
+		// whether a peer is too late for the start and starts immediately
+		lateA, lateB bool
+	}{
+		{
+			name:     "in sync",
+			proposeA: 0, proposeB: time.Second,
+			readA: time.Second + 100*time.Millisecond, readB: time.Second,
+		},
+		{
+			name:    "skewed clocks",
+			offsetA: 3 * time.Second, offsetB: -1500 * time.Millisecond,
+			proposeA: 0, proposeB: 4 * time.Second,
+			readA: 4*time.Second + 300*time.Millisecond, readB: 4 * time.Second,
+		},
+		{
+			name:     "slow ntp round of the remote",
+			offsetA:  -700 * time.Millisecond,
+			proposeA: 0, proposeB: 6 * time.Second,
+			readA: 6*time.Second + 500*time.Millisecond, readB: 6 * time.Second,
+		},
+		{
+			name:     "signal slower than the lead",
+			offsetB:  2 * time.Second,
+			proposeA: 0, proposeB: time.Second,
+			readA: time.Second + defaultPunchLead + time.Second, readB: time.Second,
+			lateA: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// each peer sees reference time minus its offset on its clock
+			local := func(at, offset time.Duration) time.Time {
+				return ref.Add(at).Add(-offset)
+			}
+			punchAtA := ref.Add(tt.proposeA).Add(defaultPunchLead).UnixMilli()
+			punchAtB := ref.Add(tt.proposeB).Add(defaultPunchLead).UnixMilli()
+			startA := punchStart(punchAtA, punchAtB, tt.offsetA, local(tt.readA, tt.offsetA))
+			startB := punchStart(punchAtB, punchAtA, tt.offsetB, local(tt.readB, tt.offsetB))
+			if startA.IsZero() != tt.lateA || startB.IsZero() != tt.lateB {
+				t.Fatalf("late A %t, B %t, want %t, %t", startA.IsZero(), startB.IsZero(), tt.lateA, tt.lateB)
+			}
+			if tt.lateA || tt.lateB {
+				return
+			}
+			// both start at the same reference instant, the later proposal
+			want := time.UnixMilli(max(punchAtA, punchAtB))
+			if a, b := startA.Add(tt.offsetA), startB.Add(tt.offsetB); !a.Equal(want) || !b.Equal(want) {
+				t.Fatalf("start A %s, B %s, want %s", a, b, want)
+			}
+		})
+	}
+}
+
+func TestPunchStartWithoutProposal(t *testing.T) {
+	now := time.Now()
+	proposal := now.Add(defaultPunchLead).UnixMilli()
+	tests := []struct {
+		name          string
+		local, remote int64
+	}{
+		{"remote", proposal, 0},
+		{"local", 0, proposal},
+	}
+	for _, tt := range tests {
+		if start := punchStart(tt.local, tt.remote, 0, now); !start.IsZero() {
+			t.Errorf("no %s proposal: start %s, want immediately", tt.name, start)
+		}
+	}
+}
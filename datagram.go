@@ -0,0 +1,92 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/quic-go/quic-go/quicvarint"
+)
+
+// Datagrams start with the varint id of the flow they belong to. SendDatagram
+// uses userDatagramID, forwarded UDP flows use the ids they negotiated.
+const userDatagramID = 0
+
+// ErrDatagramTooLarge is returned by SendDatagram for datagrams larger than MaxDatagramSize.
+var ErrDatagramTooLarge = errors.New("datagram too large")
+
+func errDatagramTooLarge(size, limit int) error {
+	return fmt.Errorf("%w: %d bytes, max %d", ErrDatagramTooLarge, size, limit)
+}
+
+// SendDatagram sends b as an unreliable datagram (QUIC DATAGRAM frames, RFC
+// 9221): it is not retransmitted and may be lost or reordered, which suits
+// latency sensitive traffic like games and voice. It returns
+// ErrDatagramsUnsupported on the TCP fallback and ErrDatagramTooLarge for
+// datagrams larger than MaxDatagramSize.
+func (p *Peer) SendDatagram(b []byte) error {
+	limit := p.MaxDatagramSize()
+	if limit == 0 {
+		return ErrDatagramsUnsupported
+	}
+	if len(b) > limit {
+		return errDatagramTooLarge(len(b), limit)
+	}
+	return p.tr.SendDatagram(append(quicvarint.Append(nil, userDatagramID), b...))
+}
+
+// ReceiveDatagram returns the next datagram from the remote.
+func (p *Peer) ReceiveDatagram(ctx context.Context) ([]byte, error) {
+	if p.MaxDatagramSize() == 0 {
+		return nil, ErrDatagramsUnsupported
+	}
+	select {
+	case b := <-p.datagrams:
+		return b, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-p.datagramsDone:
+		return nil, net.ErrClosed
+	}
+}
+
+// MaxDatagramSize is the largest datagram payload the connection carries,
+// zero if it does not support datagrams.
+func (p *Peer) MaxDatagramSize() int {
+	n := p.tr.MaxDatagramSize()
+	if n == 0 {
+		return 0
+	}
+	return n - int(quicvarint.Len(userDatagramID))
+}
+
+// receiveDatagrams hands datagrams to ReceiveDatagram or their UDP flow until
+// the transport closes.
+func (p *Peer) receiveDatagrams() {
+	defer close(p.datagramsDone)
+	for {
+		b, err := p.tr.ReceiveDatagram(context.Background())
+		if err != nil {
+			return
+		}
+		r := bytes.NewReader(b)
+		id, err := quicvarint.Read(r)
+		if err != nil {
+			continue
+		}
+		payload := b[len(b)-r.Len():]
+		if id == userDatagramID {
+			select {
+			case p.datagrams <- payload:
+			default:
+				// reader too slow, drop the datagram
+			}
+			continue
+		}
+		if f := p.flow(id); f != nil {
+			f.receive(payload)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDatagrams(t *testing.T) {
+	for _, pp := range peerPairs {
+		t.Run(pp.name, func(t *testing.T) {
+			a, b := pp.pair(t)
+			if a.MaxDatagramSize() == 0 {
+				// e.g. the TCP fallback
+				if err := a.SendDatagram([]byte("hello")); !errors.Is(err, ErrDatagramsUnsupported) {
+					t.Fatalf("send: %v, want %v", err, ErrDatagramsUnsupported)
+				}
+				return
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			if err := a.SendDatagram(make([]byte, a.MaxDatagramSize()+1)); !errors.Is(err, ErrDatagramTooLarge) {
+				t.Fatalf("oversized datagram: %v, want %v", err, ErrDatagramTooLarge)
+			}
+			full := make([]byte, a.MaxDatagramSize())
+			copy(full, "full")
+			for _, want := range [][]byte{[]byte("hello"), full} {
+				sendCtx, stop := context.WithCancel(ctx)
+				go func() {
+					// datagrams may get lost, resend until one arrives
+					for sendCtx.Err() == nil {
+						if err := a.SendDatagram(want); err != nil {
+							t.Error(err)
+							return
+						}
+						time.Sleep(20 * time.Millisecond)
+					}
+				}()
+				got, err := b.ReceiveDatagram(ctx)
+				stop()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != string(want) {
+					t.Fatalf("got %d bytes %.8q, want %d bytes %.8q", len(got), got, len(want), want)
+				}
+				// drain the resent copies
+				for {
+					drainCtx, done := context.WithTimeout(ctx, 100*time.Millisecond)
+					_, err := b.ReceiveDatagram(drainCtx)
+					done()
+					if err != nil {
+						break
+					}
+				}
+			}
+		})
+	}
+}
@@ -7,11 +7,10 @@ import (
 	"encoding/hex"
 	"flag"
 	"fmt"
-	"io"
-	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 	"tunnel"
 )
 
@@ -20,6 +19,10 @@ var (
 	signalType = flag.String("signal", "mock", "signal type: mock or cloudflare")
 	workerURL  = flag.String("worker", "", "Cloudflare Worker URL (required when -signal=cloudflare)")
 	room       = flag.String("room", "", "room token; auto-generated and printed if empty (first peer)")
+	tcp        = flag.Bool("tcp", false, "fall back to TCP hole punching when UDP fails")
+	relayURL   = flag.String("relay", "", "relay URL (ws:// or wss://) used when hole punching fails")
+	useHTTP3   = flag.Bool("http3", false, "run HTTP/3 on the QUIC connection instead of HTTP/2")
+	useWebRTC  = flag.Bool("webrtc", false, "connect over WebRTC data channels, e.g. to talk to a browser")
 )
 
 func main() {
@@ -39,21 +42,42 @@ func main() {
 		return
 	}
 
-	t, err := tunnel.NewTunnel(ctx, s)
+	var opts []tunnel.Option
+	if *tcp {
+		opts = append(opts, tunnel.WithTCPFallback())
+	}
+	if *relayURL != "" {
+		opts = append(opts, tunnel.WithRelay(*relayURL))
+	}
+	t, err := tunnel.NewTunnel(ctx, s, opts...)
 	if err != nil {
 		fmt.Printf("Error: %s\n", err)
 		return
 	}
-	if err = t.Connect(); err != nil {
-		fmt.Printf("Error: %s\n", err)
-		return
+	var peer *tunnel.Peer
+	if *useWebRTC {
+		peer, err = t.ConnectWebRTC()
+		if err != nil {
+			fmt.Printf("ConnectWebRTC error: %s\n", err)
+			return
+		}
+	} else {
+		if err = t.Connect(); err != nil {
+			fmt.Printf("Error: %s\n", err)
+			return
+		}
+		if *useHTTP3 {
+			peer, err = t.ConnectHTTP3()
+		} else {
+			peer, err = t.ConnectHTTP2()
+		}
+		if err != nil {
+			fmt.Printf("Connect HTTP error: %s\n", err)
+			return
+		}
 	}
 
-	peer, err := t.ConnectHTTP2()
-	if err != nil {
-		fmt.Printf("ConnectHTTP2 error: %s\n", err)
-		return
-	}
+	defer peer.Close()
 
 	runChat(ctx, peer)
 }
@@ -84,127 +108,70 @@ func newSignal(ctx context.Context) (tunnel.Signal, error) {
 }
 
 // runChat wires up a symmetric chat: both peers can send and receive messages.
+// Each side receives on the "chat" channel the remote opens and sends on the
+// one it opens itself.
 func runChat(ctx context.Context, peer *tunnel.Peer) {
 	displayName := *name
 
-	// outbox fans out messages to all connected remote peers
-	type subscriber struct {
-		ch   chan string
-		done <-chan struct{}
-	}
-	subCh := make(chan subscriber, 8)
-
-	go func() {
-		var subs []subscriber
-		inbox := make(chan string, 32)
-
-		// stdin → inbox
-		go func() {
-			scanner := bufio.NewScanner(os.Stdin)
-			for scanner.Scan() {
-				line := scanner.Text()
-				if line != "" {
-					inbox <- fmt.Sprintf("[%s] %s", displayName, line)
-				}
-			}
-		}()
-
+	// remote → local stdout
+	peer.HandleChannel("chat", func(c *tunnel.Channel) {
 		for {
-			select {
-			case <-ctx.Done():
+			msg, err := c.Receive()
+			if err != nil {
 				return
-			case sub := <-subCh:
-				subs = append(subs, sub)
-			case msg := <-inbox:
-				fmt.Println(msg)
-				alive := subs[:0]
-				for _, s := range subs {
-					select {
-					case <-s.done:
-					default:
-						select {
-						case s.ch <- msg:
-						default:
-						}
-						alive = append(alive, s)
-					}
-				}
-				subs = alive
 			}
+			fmt.Println(string(msg))
 		}
-	}()
+	})
 
-	// register /chat handler so the remote peer can send messages to us
-	peer.Handle("/chat", func(w http.ResponseWriter, r *http.Request) {
-		flusher, ok := w.(http.Flusher)
-		if !ok {
-			http.Error(w, "streaming not supported", http.StatusInternalServerError)
-			return
+	// the remote may not have registered its handler yet
+	var ch *tunnel.Channel
+	for {
+		var err error
+		ch, err = peer.OpenChannel(ctx, "chat")
+		if err == nil {
+			break
 		}
-		w.Header().Set("Content-Type", "text/plain")
-		w.WriteHeader(http.StatusOK)
-		flusher.Flush()
-
-		outCh := make(chan string, 16)
-		subCh <- subscriber{ch: outCh, done: r.Context().Done()}
-
-		// remote → local stdout
-		go func() {
-			scanner := bufio.NewScanner(r.Body)
-			for scanner.Scan() {
-				if line := scanner.Text(); line != "" {
-					fmt.Println(line)
-				}
-			}
-		}()
-
-		// local outbox → remote
-		for {
-			select {
-			case <-r.Context().Done():
-				return
-			case msg := <-outCh:
-				fmt.Fprintln(w, msg)
-				flusher.Flush()
-			}
+		select {
+		case <-ctx.Done():
+			return
+		case <-peer.Done():
+			fmt.Printf("chat error: %s\n", peer.Err())
+			return
+		case <-time.After(time.Millisecond * 500):
 		}
-	})
-
-	// open a /chat stream toward the remote peer
-	pr, pw := io.Pipe()
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://tunnel/chat", pr)
-	if err != nil {
-		fmt.Printf("request error: %s\n", err)
-		return
 	}
-	req.Header.Set("Content-Type", "text/plain")
+	defer ch.Close()
+
+	fmt.Println("Connected. Type messages and press Enter.")
 
+	// local stdin → remote
+	lines := make(chan string)
 	go func() {
 		scanner := bufio.NewScanner(os.Stdin)
 		for scanner.Scan() {
-			line := scanner.Text()
-			if line == "" {
-				continue
-			}
-			msg := fmt.Sprintf("[%s] %s\n", displayName, line)
-			if _, err := pw.Write([]byte(msg)); err != nil {
-				break
+			if line := scanner.Text(); line != "" {
+				lines <- line
 			}
 		}
-		pw.Close()
+		close(lines)
 	}()
-
-	resp, err := peer.Client.Do(req)
-	if err != nil {
-		fmt.Printf("chat error: %s\n", err)
-		return
-	}
-	defer resp.Body.Close()
-
-	fmt.Println("Connected. Type messages and press Enter.")
-
-	scanner := bufio.NewScanner(resp.Body)
-	for scanner.Scan() {
-		fmt.Println(scanner.Text())
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-peer.Done():
+			fmt.Printf("peer gone: %s\n", peer.Err())
+			return
+		case line, ok := <-lines:
+			if !ok {
+				return
+			}
+			msg := fmt.Sprintf("[%s] %s", displayName, line)
+			if err := ch.Send([]byte(msg)); err != nil {
+				fmt.Printf("chat error: %s\n", err)
+				return
+			}
+		}
 	}
 }
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"tunnel/relay"
+)
+
+var (
+	addr     = flag.String("addr", ":443", "listen address")
+	certFile = flag.String("cert", "", "TLS certificate file; plain HTTP when empty")
+	keyFile  = flag.String("key", "", "TLS key file")
+)
+
+func main() {
+	flag.Parse()
+
+	http.Handle("/relay", relay.NewServer())
+
+	fmt.Printf("Relay listening on %s\n", *addr)
+	var err error
+	if *certFile == "" {
+		err = http.ListenAndServe(*addr, nil)
+	} else {
+		err = http.ListenAndServeTLS(*addr, *certFile, *keyFile, nil)
+	}
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+	}
+}
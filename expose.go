@@ -0,0 +1,226 @@
+package tunnel
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+)
+
+// Expose serves the HTTP service at upstream, e.g. "http://localhost:3000",
+// to the remote under pathPrefix: the remote's GET https://tunnel/app/x
+// becomes GET http://localhost:3000/x after Expose("/app", ...). Bodies are
+// streamed both ways and redirects to upstream are rewritten to pathPrefix.
+// WebSockets the remote opens with WebSocketDialer pass through as an
+// HTTP/1.1 upgrade towards upstream; like UpgradeWebSocket this needs HTTP/2
+// and GODEBUG=http2xconnect=1 on this side, Expose warns without it.
+func (p *Peer) Expose(pathPrefix, upstream string) error {
+	target, err := url.Parse(upstream)
+	if err != nil {
+		return err
+	}
+	if (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return fmt.Errorf("upstream %s is not an http(s) url", upstream)
+	}
+	prefix := strings.TrimSuffix("/"+strings.Trim(pathPrefix, "/"), "/")
+	if strings.HasPrefix(prefix+"/", "/"+reservedPrefix) {
+		return fmt.Errorf("path %s is reserved", pathPrefix)
+	}
+
+	e := &exposed{prefix: prefix, target: target}
+	e.proxy = &httputil.ReverseProxy{
+		Rewrite:        e.rewrite,
+		ModifyResponse: e.modifyResponse,
+		// stream server-sent events and other long responses as they come
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Debugf("expose %s error: %s\n", r.URL, err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	if p.h2conns != nil && !extendedConnectEnabled() {
+		// the remote's WebSocketDialer gets ErrExtendedConnectDisabled
+		log.Warnf("websockets to %s under %s need GODEBUG=http2xconnect=1\n", upstream, prefix+"/")
+	}
+	p.mux.Handle(prefix+"/", e)
+	return nil
+}
+
+// exposed is a local HTTP service mounted under prefix.
+type exposed struct {
+	prefix string
+	target *url.URL
+	proxy  *httputil.ReverseProxy
+}
+
+func (e *exposed) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect && r.Header.Get(":protocol") != "" {
+		e.upgrade(w, r)
+		return
+	}
+	e.proxy.ServeHTTP(w, r)
+}
+
+func (e *exposed) rewrite(r *httputil.ProxyRequest) {
+	r.Out.URL.Path = e.strip(r.In.URL.Path)
+	if r.In.URL.RawPath != "" {
+		r.Out.URL.RawPath = e.strip(r.In.URL.RawPath)
+	}
+	r.SetURL(e.target)
+	r.SetXForwarded()
+	if e.prefix != "" {
+		r.Out.Header.Set("X-Forwarded-Prefix", e.prefix)
+	}
+}
+
+func (e *exposed) strip(p string) string {
+	p = strings.TrimPrefix(p, e.prefix)
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	return p
+}
+
+// modifyResponse points the redirects of upstream back into prefix.
+func (e *exposed) modifyResponse(resp *http.Response) error {
+	loc := resp.Header.Get("Location")
+	if loc == "" {
+		return nil
+	}
+	u, err := url.Parse(loc)
+	if err != nil {
+		return nil
+	}
+	if u.IsAbs() {
+		if u.Host != e.target.Host {
+			// somewhere else, leave it alone
+			return nil
+		}
+		u.Scheme, u.Host, u.User = "", "", nil
+	} else if !strings.HasPrefix(u.Path, "/") {
+		// relative to the request, still within prefix
+		return nil
+	}
+	u.Path = e.prefix + "/" + strings.TrimPrefix(strings.TrimPrefix(u.Path, strings.TrimSuffix(e.target.Path, "/")), "/")
+	u.RawPath = ""
+	resp.Header.Set("Location", u.String())
+	return nil
+}
+
+// upgrade relays an extended CONNECT request to upstream as an HTTP/1.1
+// upgrade, then copies the request body to upstream and upstream to the
+// response until either side is done.
+func (e *exposed) upgrade(w http.ResponseWriter, r *http.Request) {
+	protocol := r.Header.Get(":protocol")
+	conn, err := e.dial(r)
+	if err != nil {
+		log.Debugf("expose %s upgrade error: %s\n", r.URL, err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer conn.Close()
+
+	u := *e.target
+	u.Path = strings.TrimSuffix(e.target.Path, "/") + e.strip(r.URL.Path)
+	u.RawQuery = r.URL.RawQuery
+	out, err := http.NewRequestWithContext(r.Context(), http.MethodGet, u.String(), nil)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	for k, vv := range r.Header {
+		if !strings.HasPrefix(k, ":") {
+			out.Header[k] = vv
+		}
+	}
+	out.Header.Set("Connection", "Upgrade")
+	out.Header.Set("Upgrade", protocol)
+	if strings.EqualFold(protocol, "websocket") {
+		// HTTP/2 WebSockets have no key, HTTP/1.1 requires one
+		out.Header.Set("Sec-WebSocket-Key", websocketKey())
+	}
+	out.Header.Set("X-Forwarded-Host", r.Host)
+	if e.prefix != "" {
+		out.Header.Set("X-Forwarded-Prefix", e.prefix)
+	}
+	if err = out.Write(conn); err != nil {
+		log.Debugf("expose %s upgrade error: %s\n", r.URL, err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, out)
+	if err != nil {
+		log.Debugf("expose %s upgrade error: %s\n", r.URL, err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		// refused, hand the answer to the remote as is
+		defer resp.Body.Close()
+		copyHeader(w.Header(), resp.Header)
+		w.WriteHeader(resp.StatusCode)
+		_, _ = io.Copy(w, resp.Body)
+		return
+	}
+
+	copyHeader(w.Header(), resp.Header)
+	for _, h := range []string{"Connection", "Upgrade", "Sec-Websocket-Accept"} {
+		w.Header().Del(h)
+	}
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	if err = rc.Flush(); err != nil {
+		return
+	}
+
+	go func() {
+		_, _ = io.Copy(conn, r.Body)
+		if cw, ok := conn.(closeWriter); ok {
+			_ = cw.CloseWrite()
+		} else {
+			_ = conn.Close()
+		}
+	}()
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := br.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil || rc.Flush() != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// dial connects to upstream for an upgrade.
+func (e *exposed) dial(r *http.Request) (net.Conn, error) {
+	host := e.target.Host
+	if e.target.Port() == "" {
+		port := "80"
+		if e.target.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(e.target.Hostname(), port)
+	}
+	d := &net.Dialer{Timeout: forwardTimeout}
+	if e.target.Scheme == "https" {
+		td := &tls.Dialer{NetDialer: d, Config: &tls.Config{ServerName: e.target.Hostname()}}
+		return td.DialContext(r.Context(), "tcp", host)
+	}
+	return d.DialContext(r.Context(), "tcp", host)
+}
+
+func copyHeader(dst, src http.Header) {
+	for k, vv := range src {
+		dst[k] = append(dst[k], vv...)
+	}
+}
@@ -0,0 +1,130 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExpose(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/echo":
+			_, _ = io.Copy(w, r.Body)
+		case "/events":
+			// flushed long before the handler returns
+			fmt.Fprint(w, "event: ready\n\n")
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		default:
+			fmt.Fprintf(w, "%s %s", r.URL.RequestURI(), r.Header.Get("X-Forwarded-Prefix"))
+		}
+	}))
+	defer upstream.Close()
+	payload := make([]byte, 1<<20)
+	_, _ = rand.Read(payload)
+
+	for _, pp := range peerPairs {
+		t.Run(pp.name, func(t *testing.T) {
+			a, b := pp.pair(t)
+			if err := b.Expose("/app/", upstream.URL); err != nil {
+				t.Fatal(err)
+			}
+
+			resp, err := a.Client.Get("https://tunnel/app/users?id=1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			if want := "/users?id=1 /app"; string(body) != want {
+				t.Fatalf("body %q, want %q", body, want)
+			}
+
+			resp, err = a.Client.Post("https://tunnel/app/echo", "application/octet-stream", bytes.NewReader(payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ = io.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			if !bytes.Equal(body, payload) {
+				t.Fatalf("echoed %d bytes, want %d", len(body), len(payload))
+			}
+
+			resp, err = a.Client.Get("https://tunnel/app/events")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			event := make([]byte, len("event: ready\n\n"))
+			if _, err = io.ReadFull(resp.Body, event); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestExposeRedirect(t *testing.T) {
+	a, b := newPeerPair(t)
+	var location string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", location)
+		w.WriteHeader(http.StatusFound)
+	}))
+	defer upstream.Close()
+	// upstream mounted with a path of its own, which redirects leave out
+	if err := b.Expose("/app", upstream.URL+"/base"); err != nil {
+		t.Fatal(err)
+	}
+	client := *a.Client
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	tests := []struct {
+		name     string
+		location string
+		want     string
+	}{
+		{"absolute path", "/base/home", "/app/home"},
+		{"upstream url", upstream.URL + "/base/home?tab=1", "/app/home?tab=1"},
+		{"relative", "home", "home"},
+		{"elsewhere", "https://example.com/base/home", "https://example.com/base/home"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			location = tt.location
+			resp, err := client.Get("https://tunnel/app/login")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = resp.Body.Close()
+			if loc := resp.Header.Get("Location"); loc != tt.want {
+				t.Fatalf("redirect to %q, want %q", loc, tt.want)
+			}
+		})
+	}
+}
+
+func TestExposeInvalid(t *testing.T) {
+	a, _ := newPeerPair(t)
+	tests := []struct {
+		name, prefix, upstream string
+	}{
+		{"reserved prefix", "/" + reservedPrefix + "x", "http://localhost:3000"},
+		{"reserved without slash", reservedPrefix + "proxy/", "http://localhost:3000"},
+		{"no scheme", "/app", "localhost:3000"},
+		{"not http", "/app", "ftp://localhost:21"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := a.Expose(tt.prefix, tt.upstream); err == nil {
+				t.Fatalf("exposed %s under %s", tt.upstream, tt.prefix)
+			}
+		})
+	}
+}
@@ -0,0 +1,482 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// forwardProtocol is the protocol of the streams ForwardLocal opens. After the
+// stream header the opening side sends the target, the remote answers with a
+// status byte and both pipe the stream to the target connection:
+//
+//	1 byte  target length
+//	n bytes target, host:port
+const forwardProtocol = reservedPrefix + "forward"
+
+// listenProtocol is the protocol of the control stream ForwardRemote and
+// ForwardUDPRemote open. The opening side sends an id, the network and the
+// address to listen on, the remote answers with a status byte and the address
+// it listens on. The listener lives as long as the stream:
+//
+//	1 byte  id length
+//	n bytes id
+//	1 byte  network length
+//	n bytes network, tcp or udp
+//	1 byte  address length
+//	n bytes address, host:port
+const listenProtocol = reservedPrefix + "listen"
+
+// reverseProtocol is the protocol of the streams the remote opens for the
+// connections its TCP listener accepts, carrying the id of the listener:
+//
+//	1 byte  id length
+//	n bytes id
+const reverseProtocol = reservedPrefix + "reverse"
+
+const (
+	forwardOK byte = iota
+	forwardDenied
+	forwardDialFailed
+	forwardListenFailed
+)
+
+// forwardTimeout bounds opening the stream and dialing the target for a
+// forwarded connection.
+const forwardTimeout = time.Second * 10
+
+var (
+	errForwardDenied     = errors.New("denied by remote allowlist")
+	errForwardDialFailed = errors.New("remote failed to dial target")
+	errListenFailed      = errors.New("remote failed to listen")
+)
+
+// AllowForward lets the remote reach targets matching one of patterns through
+// ForwardLocal. Patterns are host:port with IPv6 hosts in brackets, a * in
+// the host or port matches any run of characters, e.g. "localhost:8080",
+// "10.0.0.*:22", "[::1]:*" or "*:*". Nothing is allowed by default.
+func (p *Peer) AllowForward(patterns ...string) {
+	p.forwardMu.Lock()
+	defer p.forwardMu.Unlock()
+	p.forwardAllow = append(p.forwardAllow, patterns...)
+}
+
+// AllowListen lets the remote open listeners on addresses matching one of
+// patterns through ForwardRemote, patterns match like in AllowForward.
+// Nothing is allowed by default.
+func (p *Peer) AllowListen(patterns ...string) {
+	p.forwardMu.Lock()
+	defer p.forwardMu.Unlock()
+	p.listenAllow = append(p.listenAllow, patterns...)
+}
+
+func (p *Peer) forwardAllowed(target string) bool {
+	p.forwardMu.RLock()
+	defer p.forwardMu.RUnlock()
+	return matchAny(p.forwardAllow, target)
+}
+
+func (p *Peer) listenAllowed(addr string) bool {
+	p.forwardMu.RLock()
+	defer p.forwardMu.RUnlock()
+	return matchAny(p.listenAllow, addr)
+}
+
+func matchAny(patterns []string, addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range patterns {
+		hostPattern, portPattern, err := net.SplitHostPort(pattern)
+		if err != nil {
+			continue
+		}
+		if matchHost(hostPattern, host) && matchWildcard(portPattern, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchHost matches host names case-insensitively and IP addresses by value,
+// so "::1" matches "0:0::1".
+func matchHost(pattern, host string) bool {
+	if !strings.Contains(pattern, "*") {
+		if ip := net.ParseIP(pattern); ip != nil {
+			return ip.Equal(net.ParseIP(host))
+		}
+	}
+	return matchWildcard(strings.ToLower(pattern), strings.ToLower(host))
+}
+
+// matchWildcard reports whether s matches pattern, whose only special
+// character is *, matching any run of characters.
+func matchWildcard(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return strings.HasSuffix(s, last)
+}
+
+// ForwardLocal listens on listenAddr and pipes every accepted TCP connection
+// over a new stream to the remote, which dials remoteTarget, like ssh -L. The
+// remote has to allow the target with AllowForward. Closing the returned
+// listener stops forwarding, connections already forwarded stay open.
+func (p *Peer) ForwardLocal(listenAddr, remoteTarget string) (net.Listener, error) {
+	if len(remoteTarget) > 255 {
+		return nil, fmt.Errorf("target too long: %s", remoteTarget)
+	}
+	ln, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				if err := p.forward(conn, remoteTarget); err != nil {
+					log.Debugf("forward %s to %s error: %s\n", conn.RemoteAddr(), remoteTarget, err)
+				}
+			}()
+		}
+	}()
+	return ln, nil
+}
+
+// forward pipes conn to target, dialed by the remote.
+func (p *Peer) forward(conn net.Conn, target string) error {
+	s, err := p.dialRemote(target)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	pipe(conn, s.Conn)
+	return nil
+}
+
+// dialRemote opens a stream to target, dialed by the remote.
+func (p *Peer) dialRemote(target string) (*Stream, error) {
+	if len(target) > 255 {
+		return nil, fmt.Errorf("target too long: %s", target)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), forwardTimeout)
+	defer cancel()
+	s, err := p.openStream(ctx, forwardProtocol)
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		_ = s.Close()
+	})
+	status, err := requestForward(s, target)
+	if !stop() {
+		err = ctx.Err()
+	}
+	if err == nil {
+		err = forwardError(status)
+	}
+	if err != nil {
+		_ = s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func requestForward(s *Stream, target string) (byte, error) {
+	if _, err := s.Write(appendString(nil, target)); err != nil {
+		return 0, err
+	}
+	status := make([]byte, 1)
+	if _, err := io.ReadFull(s, status); err != nil {
+		return 0, err
+	}
+	return status[0], nil
+}
+
+func forwardError(status byte) error {
+	switch status {
+	case forwardOK:
+		return nil
+	case forwardDenied:
+		return errForwardDenied
+	case forwardDialFailed:
+		return errForwardDialFailed
+	case forwardListenFailed:
+		return errListenFailed
+	}
+	return fmt.Errorf("unknown forward status %d", status)
+}
+
+// serveForward dials the target a remote ForwardLocal asks for, if allowed.
+func (p *Peer) serveForward(s *Stream) {
+	_ = s.SetReadDeadline(time.Now().Add(streamHeaderTimeout))
+	target, err := readString(s)
+	if err != nil {
+		log.Debugf("read forward target error: %s\n", err)
+		_ = s.Close()
+		return
+	}
+	_ = s.SetReadDeadline(time.Time{})
+	if !p.forwardAllowed(target) {
+		log.Debugf("forward to %s denied\n", target)
+		_, _ = s.Write([]byte{forwardDenied})
+		_ = s.Close()
+		return
+	}
+	conn, err := net.DialTimeout("tcp", target, forwardTimeout)
+	if err != nil {
+		log.Debugf("forward dial %s error: %s\n", target, err)
+		_, _ = s.Write([]byte{forwardDialFailed})
+		_ = s.Close()
+		return
+	}
+	if _, err = s.Write([]byte{forwardOK}); err != nil {
+		_ = conn.Close()
+		_ = s.Close()
+		return
+	}
+	pipe(s.Conn, conn)
+}
+
+// RemoteForward is a listener ForwardRemote or ForwardUDPRemote opened on the remote.
+type RemoteForward struct {
+	p    *Peer
+	id   string
+	addr string
+	s    *Stream
+	once sync.Once
+}
+
+// Addr is the address the remote listens on, with the actual port if
+// ForwardRemote asked for port 0.
+func (f *RemoteForward) Addr() string { return f.addr }
+
+// Close closes the remote listener. TCP connections already forwarded stay
+// open, UDP flows end with the listener.
+func (f *RemoteForward) Close() error {
+	var err error
+	f.once.Do(func() {
+		f.p.forwardMu.Lock()
+		delete(f.p.reverseTargets, f.id)
+		f.p.forwardMu.Unlock()
+		err = f.s.Close()
+	})
+	return err
+}
+
+// ForwardRemote makes the remote listen on remoteListenAddr and stream every
+// connection it accepts back to us, where it is piped to localTarget, like
+// ssh -R. The remote has to allow the address with AllowListen.
+func (p *Peer) ForwardRemote(remoteListenAddr, localTarget string) (*RemoteForward, error) {
+	return p.forwardRemote("tcp", remoteListenAddr, localTarget)
+}
+
+func (p *Peer) forwardRemote(network, remoteListenAddr, localTarget string) (*RemoteForward, error) {
+	if len(remoteListenAddr) > 255 {
+		return nil, fmt.Errorf("listen address too long: %s", remoteListenAddr)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), forwardTimeout)
+	defer cancel()
+	s, err := p.openStream(ctx, listenProtocol)
+	if err != nil {
+		return nil, err
+	}
+	id := strconv.FormatUint(p.reverseID.Add(1), 10)
+	f := &RemoteForward{p: p, id: id, s: s}
+	p.forwardMu.Lock()
+	p.reverseTargets[id] = localTarget
+	p.forwardMu.Unlock()
+
+	stop := context.AfterFunc(ctx, func() {
+		_ = s.Close()
+	})
+	f.addr, err = requestListen(s, id, network, remoteListenAddr)
+	if !stop() {
+		err = ctx.Err()
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func requestListen(s *Stream, id, network, addr string) (string, error) {
+	req := appendString(nil, id)
+	req = appendString(req, network)
+	req = appendString(req, addr)
+	if _, err := s.Write(req); err != nil {
+		return "", err
+	}
+	status := make([]byte, 1)
+	if _, err := io.ReadFull(s, status); err != nil {
+		return "", err
+	}
+	if err := forwardError(status[0]); err != nil {
+		return "", err
+	}
+	return readString(s)
+}
+
+// serveListen opens the listener a remote ForwardRemote asks for, if allowed,
+// and closes it with the control stream.
+func (p *Peer) serveListen(s *Stream) {
+	defer s.Close()
+	_ = s.SetReadDeadline(time.Now().Add(streamHeaderTimeout))
+	var id, network, addr string
+	var err error
+	for _, field := range []*string{&id, &network, &addr} {
+		if *field, err = readString(s); err != nil {
+			log.Debugf("read listen request error: %s\n", err)
+			return
+		}
+	}
+	_ = s.SetReadDeadline(time.Time{})
+	if !p.listenAllowed(addr) {
+		log.Debugf("listen on %s %s denied\n", network, addr)
+		_, _ = s.Write([]byte{forwardDenied})
+		return
+	}
+	var ln io.Closer
+	var bound string
+	switch network {
+	case "tcp":
+		var tcpLn net.Listener
+		tcpLn, err = net.Listen(network, addr)
+		if err == nil {
+			ln, bound = tcpLn, tcpLn.Addr().String()
+			go p.acceptReverse(tcpLn, id)
+		}
+	case "udp":
+		var pc net.PacketConn
+		pc, err = net.ListenPacket(network, addr)
+		if err == nil {
+			ln, bound = pc, pc.LocalAddr().String()
+			go p.serveUDPListener(pc, func(ctx context.Context, deliver func([]byte)) (*udpFlow, error) {
+				return p.openUDPFlow(ctx, udpFlowReverse, id, deliver)
+			})
+		}
+	default:
+		err = fmt.Errorf("unknown network %s", network)
+	}
+	if err != nil {
+		log.Debugf("listen on %s %s error: %s\n", network, addr, err)
+		_, _ = s.Write([]byte{forwardListenFailed})
+		return
+	}
+	defer ln.Close()
+	if _, err = s.Write(appendString([]byte{forwardOK}, bound)); err != nil {
+		return
+	}
+	// the remote closes the control stream to close the listener
+	_, _ = io.Copy(io.Discard, s)
+}
+
+// acceptReverse streams the connections ln accepts back to the remote.
+func (p *Peer) acceptReverse(ln net.Listener, id string) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			if err := p.reverse(conn, id); err != nil {
+				log.Debugf("reverse forward %s error: %s\n", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// reverse streams conn, accepted by the listener with id, back to the remote.
+func (p *Peer) reverse(conn net.Conn, id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), forwardTimeout)
+	defer cancel()
+	s, err := p.openStream(ctx, reverseProtocol)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	if _, err = s.Write(appendString(nil, id)); err != nil {
+		_ = conn.Close()
+		_ = s.Close()
+		return err
+	}
+	pipe(conn, s.Conn)
+	return nil
+}
+
+// serveReverse dials the local target of a connection our ForwardRemote
+// listener accepted on the remote.
+func (p *Peer) serveReverse(s *Stream) {
+	_ = s.SetReadDeadline(time.Now().Add(streamHeaderTimeout))
+	id, err := readString(s)
+	if err != nil {
+		log.Debugf("read reverse id error: %s\n", err)
+		_ = s.Close()
+		return
+	}
+	_ = s.SetReadDeadline(time.Time{})
+	p.forwardMu.RLock()
+	target, ok := p.reverseTargets[id]
+	p.forwardMu.RUnlock()
+	if !ok {
+		log.Debugf("reverse forward %s unknown\n", id)
+		_ = s.Close()
+		return
+	}
+	conn, err := net.DialTimeout("tcp", target, forwardTimeout)
+	if err != nil {
+		log.Debugf("reverse forward dial %s error: %s\n", target, err)
+		_ = s.Close()
+		return
+	}
+	pipe(s.Conn, conn)
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// pipe copies between a and b in both directions until both are done, then
+// closes them. An EOF is passed on as a half-close where the conn supports it.
+func pipe(a, b net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	cp := func(dst, src net.Conn) {
+		defer wg.Done()
+		_, _ = io.Copy(dst, src)
+		if cw, ok := dst.(closeWriter); ok {
+			_ = cw.CloseWrite()
+		} else {
+			_ = dst.Close()
+		}
+	}
+	go cp(a, b)
+	go cp(b, a)
+	wg.Wait()
+	_ = a.Close()
+	_ = b.Close()
+}
@@ -0,0 +1,187 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMatchAny(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		addr     string
+		want     bool
+	}{
+		// IPv4
+		{[]string{"127.0.0.1:22"}, "127.0.0.1:22", true},
+		{[]string{"127.0.0.1:22"}, "127.0.0.1:23", false},
+		{[]string{"127.0.0.1:22"}, "127.0.0.10:22", false},
+		{[]string{"10.0.0.*:22"}, "10.0.0.7:22", true},
+		{[]string{"10.0.0.*:22"}, "10.0.1.7:22", false},
+		{[]string{"10.0.0.1:*"}, "10.0.0.1:5432", true},
+		// IPv6
+		{[]string{"[::1]:22"}, "[::1]:22", true},
+		{[]string{"[::1]:22"}, "[0:0::1]:22", true},
+		{[]string{"[::1]:22"}, "[::2]:22", false},
+		{[]string{"[::1]:22"}, "[::1]:2", false},
+		{[]string{"[::1]:*"}, "[::1]:8080", true},
+		{[]string{"[fd00::*]:80"}, "[fd00::5]:80", true},
+		{[]string{"[fd00::*]:80"}, "[fd01::5]:80", false},
+		// a character class in path.Match, taken literally here
+		{[]string{"[::1]:22"}, ":22", false},
+		// host names
+		{[]string{"localhost:5432"}, "localhost:5432", true},
+		{[]string{"localhost:5432"}, "LocalHost:5432", true},
+		{[]string{"*.corp.internal:*"}, "git.corp.internal:443", true},
+		{[]string{"*.corp.internal:*"}, "corp.internal:443", false},
+		{[]string{"*.corp.internal:*"}, "git.corp.internal.evil.com:443", false},
+		// anything
+		{[]string{"*:*"}, "example.com:443", true},
+		{[]string{"*:*"}, "[2001:db8::1]:443", true},
+		{[]string{"*:*"}, "not-an-address", false},
+		// several patterns, broken ones are skipped
+		{[]string{"nonsense", "localhost:80"}, "localhost:80", true},
+		{nil, "localhost:80", false},
+	}
+	for _, tt := range tests {
+		if got := matchAny(tt.patterns, tt.addr); got != tt.want {
+			t.Errorf("matchAny(%q, %q) = %t, want %t", tt.patterns, tt.addr, got, tt.want)
+		}
+	}
+}
+
+// listenEcho runs a TCP server echoing every connection until the client
+// half-closes it, and returns its address.
+func listenEcho(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// echoThrough sends payload to the echo server behind addr, half-closes
+// and expects all of it back before EOF.
+func echoThrough(t *testing.T, addr string, payload []byte) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	go func() {
+		_, _ = conn.Write(payload)
+		_ = conn.(*net.TCPConn).CloseWrite()
+	}()
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("echoed %d bytes, want %d", len(got), len(payload))
+	}
+}
+
+func TestForwardLocal(t *testing.T) {
+	payload := make([]byte, 256<<10)
+	_, _ = rand.Read(payload)
+	for _, pp := range peerPairs {
+		t.Run(pp.name, func(t *testing.T) {
+			a, b := pp.pair(t)
+			echo := listenEcho(t)
+			b.AllowForward(echo)
+
+			ln, err := a.ForwardLocal("127.0.0.1:0", echo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			echoThrough(t, ln.Addr().String(), payload)
+		})
+	}
+}
+
+func TestForwardLocalDenied(t *testing.T) {
+	a, b := newPeerPair(t)
+	b.AllowForward("127.0.0.1:1")
+
+	// not on the remote's allowlist, the connection is closed
+	ln, err := a.ForwardLocal("127.0.0.1:0", listenEcho(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if n, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("read %d bytes from a denied forward", n)
+	}
+}
+
+func TestForwardRemote(t *testing.T) {
+	for _, pp := range peerPairs {
+		t.Run(pp.name, func(t *testing.T) {
+			a, b := pp.pair(t)
+			b.AllowListen("127.0.0.1:*")
+
+			f, err := a.ForwardRemote("127.0.0.1:0", listenEcho(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// several connections through the one remote listener
+			for i := range 3 {
+				echoThrough(t, f.Addr(), bytes.Repeat([]byte{byte(i)}, 4<<10))
+			}
+
+			if err = f.Close(); err != nil {
+				t.Fatal(err)
+			}
+			// the remote stops listening once the forward is closed
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				conn, err := net.Dial("tcp", f.Addr())
+				if err != nil {
+					break
+				}
+				_ = conn.Close()
+				if time.Now().After(deadline) {
+					t.Fatal("remote still listening after Close")
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestForwardRemoteNotAllowed(t *testing.T) {
+	a, b := newPeerPair(t)
+	b.AllowListen("127.0.0.1:*")
+	for _, addr := range []string{"0.0.0.0:0", "localhost:0", "[::1]:0"} {
+		if f, err := a.ForwardRemote(addr, listenEcho(t)); err == nil {
+			_ = f.Close()
+			t.Errorf("remote listened on %s", addr)
+		}
+	}
+}
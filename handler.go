@@ -0,0 +1,154 @@
+package tunnel
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"runtime/debug"
+	"time"
+)
+
+// Middleware wraps the handler of the requests the remote sends, e.g. for
+// authentication or access logging.
+type Middleware func(http.Handler) http.Handler
+
+// Handle registers a handler on the local HTTP server (served to the remote peer).
+// Patterns are those of http.ServeMux.
+func (p *Peer) Handle(pattern string, handler http.Handler) {
+	p.mux.Handle(pattern, handler)
+}
+
+// HandleFunc registers a handler function like Handle.
+func (p *Peer) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	p.mux.HandleFunc(pattern, handler)
+}
+
+// SetHandler makes h, e.g. a chi or gorilla router, the root handler of the
+// remote's requests. Routes registered with Handle, HandleFunc and Expose
+// take precedence, h gets the requests none of them matches.
+func (p *Peer) SetHandler(h http.Handler) {
+	p.handlerMu.Lock()
+	defer p.handlerMu.Unlock()
+	p.handler = h
+}
+
+// Use appends middleware around every handler of the Peer, the first one
+// added runs outermost. Only tunnel's own endpoints skip middleware, like the
+// one of the remote's HTTP proxy, which is guarded by AllowForward instead.
+func (p *Peer) Use(middleware ...Middleware) {
+	p.handlerMu.Lock()
+	defer p.handlerMu.Unlock()
+	p.middleware = append(p.middleware, middleware...)
+	var h http.Handler = http.HandlerFunc(p.route)
+	for i := len(p.middleware) - 1; i >= 0; i-- {
+		h = p.middleware[i](h)
+	}
+	p.chain = h
+}
+
+// serveHTTP is the handler of the Peer's HTTP server.
+func (p *Peer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if !p.track() {
+		http.Error(w, "peer shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer p.inflight.Done()
+	if h, ok := p.internal[r.URL.Path]; ok {
+		h(w, r)
+		return
+	}
+	p.handlerMu.RLock()
+	chain := p.chain
+	p.handlerMu.RUnlock()
+	chain.ServeHTTP(w, r)
+}
+
+// route picks the mux route matching r, or the root handler.
+func (p *Peer) route(w http.ResponseWriter, r *http.Request) {
+	if h, pattern := p.mux.Handler(r); pattern != "" {
+		h.ServeHTTP(w, r)
+		return
+	}
+	p.handlerMu.RLock()
+	h := p.handler
+	p.handlerMu.RUnlock()
+	if h == nil {
+		http.NotFound(w, r)
+		return
+	}
+	h.ServeHTTP(w, r)
+}
+
+// LogRequests returns middleware writing a line per request to out, once the
+// handler returns:
+//
+//	remote-addr method uri proto status bytes duration
+func LogRequests(out io.Writer) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			sw := &statusWriter{ResponseWriter: w}
+			defer func() {
+				if sw.status == 0 {
+					sw.status = http.StatusOK
+				}
+				_, _ = fmt.Fprintf(out, "%s %s %s %s %d %d %s\n",
+					r.RemoteAddr, r.Method, r.RequestURI, r.Proto, sw.status, sw.bytes, time.Since(start))
+			}()
+			next.ServeHTTP(sw, r)
+		})
+	}
+}
+
+// Recover is middleware turning a panicking handler into a 500 response
+// instead of a reset stream. The panic and its stack are logged as a warning.
+func Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+			log.Warnf("panic serving %s %s: %v\n%s", r.Method, r.URL, err, debug.Stack())
+			// too late if the handler already wrote the header
+			w.WriteHeader(http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// statusWriter records the status and size of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush keeps streaming handlers working that check for http.Flusher.
+func (w *statusWriter) Flush() {
+	_ = http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap gives http.ResponseController access to the wrapped writer.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
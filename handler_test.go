@@ -0,0 +1,39 @@
+package tunnel
+
+import (
+	"net/http"
+	"testing"
+)
+
+// TestMiddlewareReservedPaths checks that only the exact internal routes
+// skip middleware, not everything under the reserved prefix.
+func TestMiddlewareReservedPaths(t *testing.T) {
+	a, b := newPeerPair(t)
+	b.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+	b.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "denied", http.StatusUnauthorized)
+		})
+	})
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/", http.StatusUnauthorized},
+		{"/tunnel/anything", http.StatusUnauthorized},
+		{"/tunnel/proxy/", http.StatusUnauthorized},
+		// the proxy endpoint itself, which wants a proxy url
+		{proxyPath, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		resp, err := a.Client.Get("https://tunnel" + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("GET %s: status %d, want %d", tt.path, resp.StatusCode, tt.want)
+		}
+	}
+}
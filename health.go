@@ -0,0 +1,228 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go/logging"
+)
+
+// pingProtocol is the protocol of the streams Ping opens. The opening side
+// writes 8 byte nonces, the remote echoes each until the stream ends.
+const pingProtocol = reservedPrefix + "ping"
+
+// Liveness defaults: a ping every livenessInterval, the Peer is gone once no
+// pong arrived for livenessTimeout.
+const (
+	livenessInterval = time.Second * 5
+	livenessTimeout  = time.Second * 30
+)
+
+// ErrPeerUnresponsive is the Err of a Peer whose remote stopped answering pings.
+var ErrPeerUnresponsive = errors.New("peer unresponsive")
+
+var errPongMismatch = errors.New("pong does not match ping")
+
+// Stats describes the health of the connection to the remote.
+type Stats struct {
+	// RTT is the latest round-trip time, SmoothedRTT its moving average and
+	// MinRTT the lowest seen. With QUIC they come from the connection's
+	// acknowledgements, otherwise from the pings.
+	RTT         time.Duration
+	SmoothedRTT time.Duration
+	MinRTT      time.Duration
+	// PacketsSent and PacketsLost count QUIC packets, zero on other transports.
+	PacketsSent uint64
+	PacketsLost uint64
+	// PingsSent and PingsLost count the liveness pings and Ping calls, a ping
+	// is lost if it was not answered in time.
+	PingsSent uint64
+	PingsLost uint64
+	// Loss is the ratio of lost QUIC packets, or of lost pings without QUIC.
+	Loss float64
+	// LastPong is when the remote last answered a ping.
+	LastPong time.Time
+}
+
+// Ping measures the round-trip time to the remote's ping handler.
+func (p *Peer) Ping(ctx context.Context) (time.Duration, error) {
+	p.pingMu.Lock()
+	p.pingStats.PingsSent++
+	p.pingMu.Unlock()
+	rtt, err := p.ping(ctx)
+	p.pingMu.Lock()
+	defer p.pingMu.Unlock()
+	if err != nil {
+		p.pingStats.PingsLost++
+		return 0, err
+	}
+	s := &p.pingStats
+	s.RTT = rtt
+	s.LastPong = time.Now()
+	if s.MinRTT == 0 || rtt < s.MinRTT {
+		s.MinRTT = rtt
+	}
+	if s.SmoothedRTT == 0 {
+		s.SmoothedRTT = rtt
+	} else {
+		s.SmoothedRTT = (7*s.SmoothedRTT + rtt) / 8
+	}
+	return rtt, nil
+}
+
+func (p *Peer) ping(ctx context.Context) (time.Duration, error) {
+	s, err := p.openStream(ctx, pingProtocol)
+	if err != nil {
+		return 0, err
+	}
+	defer s.Close()
+	stop := context.AfterFunc(ctx, func() { _ = s.SetDeadline(time.Now()) })
+	defer stop()
+
+	nonce := binary.BigEndian.AppendUint64(nil, p.pingID.Add(1))
+	start := time.Now()
+	if _, err = s.Write(nonce); err != nil {
+		return 0, err
+	}
+	pong := make([]byte, len(nonce))
+	if _, err = io.ReadFull(s, pong); err != nil {
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		return 0, err
+	}
+	if string(pong) != string(nonce) {
+		return 0, errPongMismatch
+	}
+	return time.Since(start), nil
+}
+
+// servePing echoes the nonces of a ping stream.
+func (p *Peer) servePing(s *Stream) {
+	defer s.Close()
+	_, _ = io.Copy(s, s)
+}
+
+// Stats returns the current health statistics of the connection.
+func (p *Peer) Stats() Stats {
+	p.pingMu.Lock()
+	st := p.pingStats
+	p.pingMu.Unlock()
+	if st.PingsSent > 0 {
+		st.Loss = float64(st.PingsLost) / float64(st.PingsSent)
+	}
+	if qt, ok := p.tr.(*quicTransport); ok && qt.stats != nil {
+		qt.stats.fill(&st)
+	}
+	return st
+}
+
+// SetLiveness changes how often the remote is pinged and after how long
+// without a pong the Peer is closed with ErrPeerUnresponsive. A zero timeout
+// turns the check off. The defaults are 5 and 30 seconds.
+func (p *Peer) SetLiveness(interval, timeout time.Duration) {
+	if interval <= 0 {
+		interval = livenessInterval
+	}
+	p.livenessInterval.Store(int64(interval))
+	p.livenessTimeout.Store(int64(timeout))
+	select {
+	case p.livenessChanged <- struct{}{}:
+	default:
+	}
+}
+
+// checkLiveness pings the remote until the Peer is gone and closes it when
+// the pongs stop.
+func (p *Peer) checkLiveness() {
+	lastPong := time.Now()
+	timer := time.NewTimer(time.Duration(p.livenessInterval.Load()))
+	defer timer.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-p.livenessChanged:
+			timer.Reset(time.Duration(p.livenessInterval.Load()))
+			continue
+		case <-timer.C:
+		}
+		interval := time.Duration(p.livenessInterval.Load())
+		timeout := time.Duration(p.livenessTimeout.Load())
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		_, err := p.Ping(ctx)
+		cancel()
+		switch {
+		case err == nil:
+			lastPong = time.Now()
+		case errors.Is(err, net.ErrClosed):
+			return
+		default:
+			log.Debugf("ping error: %s\n", err)
+		}
+		if timeout > 0 && time.Since(lastPong) > timeout {
+			log.Debugf("no pong for %s, closing peer\n", time.Since(lastPong).Round(time.Millisecond))
+			p.closeWith(ErrPeerUnresponsive)
+			return
+		}
+		timer.Reset(interval)
+	}
+}
+
+// quicStats collects the RTT and loss of a QUIC connection from its tracer,
+// and the largest DATAGRAM frame the remote accepts.
+type quicStats struct {
+	logging.NullConnectionTracer
+	sent atomic.Uint64
+	lost atomic.Uint64
+
+	maxDatagramFrame atomic.Int64
+
+	mu       sync.Mutex
+	rtt      time.Duration
+	smoothed time.Duration
+	min      time.Duration
+}
+
+func (s *quicStats) SentLongHeaderPacket(*logging.ExtendedHeader, logging.ByteCount, *logging.AckFrame, []logging.Frame) {
+	s.sent.Add(1)
+}
+
+func (s *quicStats) SentShortHeaderPacket(*logging.ShortHeader, logging.ByteCount, *logging.AckFrame, []logging.Frame) {
+	s.sent.Add(1)
+}
+
+func (s *quicStats) LostPacket(logging.EncryptionLevel, logging.PacketNumber, logging.PacketLossReason) {
+	s.lost.Add(1)
+}
+
+func (s *quicStats) ReceivedTransportParameters(p *logging.TransportParameters) {
+	s.maxDatagramFrame.Store(int64(p.MaxDatagramFrameSize))
+}
+
+func (s *quicStats) UpdatedMetrics(rtt *logging.RTTStats, _, _ logging.ByteCount, _ int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rtt = rtt.LatestRTT()
+	s.smoothed = rtt.SmoothedRTT()
+	s.min = rtt.MinRTT()
+}
+
+func (s *quicStats) fill(st *Stats) {
+	s.mu.Lock()
+	if s.rtt > 0 {
+		st.RTT, st.SmoothedRTT, st.MinRTT = s.rtt, s.smoothed, s.min
+	}
+	s.mu.Unlock()
+	st.PacketsSent = s.sent.Load()
+	st.PacketsLost = s.lost.Load()
+	if st.PacketsSent > 0 {
+		st.Loss = float64(st.PacketsLost) / float64(st.PacketsSent)
+	}
+}
@@ -0,0 +1,92 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPing(t *testing.T) {
+	for _, pp := range peerPairs {
+		t.Run(pp.name, func(t *testing.T) {
+			a, b := pp.pair(t)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			for range 3 {
+				rtt, err := a.Ping(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if rtt <= 0 {
+					t.Fatalf("rtt %s", rtt)
+				}
+			}
+			st := a.Stats()
+			if st.PingsSent != 3 || st.PingsLost != 0 {
+				t.Fatalf("%d pings sent, %d lost, want 3 and 0", st.PingsSent, st.PingsLost)
+			}
+			if st.MinRTT <= 0 || st.MinRTT > st.SmoothedRTT || st.LastPong.IsZero() {
+				t.Fatalf("stats %+v", st)
+			}
+			// pings are counted on the side sending them
+			if st := b.Stats(); st.PingsSent != 0 {
+				t.Fatalf("remote sent %d pings", st.PingsSent)
+			}
+
+			// a ping the remote leaves unanswered ends with its context
+			b.handleStream(pingProtocol, func(s *Stream) {
+				<-b.Done()
+				_ = s.Close()
+			})
+			canceled, cancel := context.WithCancel(ctx)
+			time.AfterFunc(50*time.Millisecond, cancel)
+			if _, err := a.Ping(canceled); !errors.Is(err, context.Canceled) {
+				t.Fatalf("ping canceled: %v", err)
+			}
+			if st := a.Stats(); st.PingsLost != 1 {
+				t.Fatalf("%d pings lost, want 1", st.PingsLost)
+			}
+		})
+	}
+}
+
+func TestLiveness(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		// the remote stops answering pings
+		silent  bool
+		wantErr error
+	}{
+		{name: "answered", timeout: 200 * time.Millisecond},
+		{name: "unanswered", timeout: 200 * time.Millisecond, silent: true, wantErr: ErrPeerUnresponsive},
+		{name: "disabled", silent: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := newPeerPair(t)
+			if tt.silent {
+				b.handleStream(pingProtocol, func(s *Stream) {
+					<-b.Done()
+					_ = s.Close()
+				})
+			}
+			a.SetLiveness(20*time.Millisecond, tt.timeout)
+
+			select {
+			case <-a.Done():
+				if tt.wantErr == nil {
+					t.Fatalf("closed: %v", a.Err())
+				}
+				if !errors.Is(a.Err(), tt.wantErr) {
+					t.Fatalf("err %v, want %v", a.Err(), tt.wantErr)
+				}
+			case <-time.After(time.Second):
+				if tt.wantErr != nil {
+					t.Fatal("peer still up without pongs")
+				}
+			}
+		})
+	}
+}
@@ -1,11 +1,15 @@
 package tunnel
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
 	"net"
+	"sync"
 	"sync/atomic"
 	"time"
+
+	"golang.org/x/net/ipv4"
 )
 
 // TODO: better timeout
@@ -14,199 +18,540 @@ const timeout = time.Second * 30
 // probability of success is 98.34%
 const triesNum = 512
 
+// socketLifetime is how long a birthday attack socket waits for the remote,
+// the remote sprays its candidates right at the negotiated punch start.
+const socketLifetime = time.Second * 5
+
+// statsInterval is how often punching progress is logged.
+const statsInterval = time.Second
+
+// TTLStrategy sends the first punching packets of every socket with a reduced
+// IP TTL. They create the mapping in our own NAT but expire before reaching the
+// remote NAT, so NATs that blacklist a flow after an unsolicited inbound packet
+// never see them. The socket switches back to its normal TTL after Packets
+// low-TTL packets, or as soon as the remote is heard from.
+type TTLStrategy struct {
+	// TTL of the initial packets, large enough to pass our own NAT and small
+	// enough to expire before the remote NAT, typically 2-4.
+	TTL int
+	// Packets is how many packets per socket are sent with the reduced TTL,
+	// zero disables the strategy.
+	Packets int
+}
+
+// WithTTLStrategy enables low-TTL initial punch packets.
+func WithTTLStrategy(s TTLStrategy) Option {
+	return func(t *Tunnel) {
+		t.ttl = s
+	}
+}
+
+// WithPunchConcurrency bounds how many sockets the birthday attack keeps open
+// at once. Defaults to triesNum; lower values rotate sockets and trade success
+// probability for file descriptors.
+func WithPunchConcurrency(n int) Option {
+	return func(t *Tunnel) {
+		t.punchConcurrency = n
+	}
+}
+
+// PunchStats is a snapshot of hole punching progress, for diagnostics.
+type PunchStats struct {
+	// Strategy is the punching strategy in use, empty before punching starts.
+	Strategy        string
+	PacketsSent     int64
+	PacketsReceived int64
+	// SocketsOpen is the number of punching sockets currently open,
+	// SocketsTotal the number opened so far.
+	SocketsOpen  int64
+	SocketsTotal int64
+}
+
+type punchStats struct {
+	strategy    atomic.Pointer[string]
+	sent        atomic.Int64
+	received    atomic.Int64
+	socketsOpen atomic.Int64
+	sockets     atomic.Int64
+}
+
+func (s *punchStats) snapshot() PunchStats {
+	stats := PunchStats{
+		PacketsSent:     s.sent.Load(),
+		PacketsReceived: s.received.Load(),
+		SocketsOpen:     s.socketsOpen.Load(),
+		SocketsTotal:    s.sockets.Load(),
+	}
+	if strategy := s.strategy.Load(); strategy != nil {
+		stats.Strategy = *strategy
+	}
+	return stats
+}
+
+// report logs progress until ctx is done.
+func (s *punchStats) report(ctx context.Context) {
+	tick := time.NewTicker(statsInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			stats := s.snapshot()
+			log.Debugf("punch %s: sent %d, received %d, sockets open %d/%d\n", stats.Strategy,
+				stats.PacketsSent, stats.PacketsReceived, stats.SocketsOpen, stats.SocketsTotal)
+		}
+	}
+}
+
+// PunchStats returns the hole punching progress accumulated by Connect.
+func (t *Tunnel) PunchStats() PunchStats {
+	return t.stats.snapshot()
+}
+
+// punchConn is a punching socket. It applies the tunnel's TTLStrategy to the
+// handshake messages it sends, accounts traffic in the tunnel's punchStats and
+// is closed as soon as its context is done, unblocking any pending read.
+type punchConn struct {
+	conn      *net.UDPConn
+	stats     *punchStats
+	stopClose func() bool
+	ipConn    *ipv4.Conn
+	normal    int
+	low       atomic.Int32
+	restore   sync.Once
+	closeOnce sync.Once
+	kept      bool
+}
+
+func newPunchConn(ctx context.Context, tunnel *Tunnel, conn *net.UDPConn) *punchConn {
+	c := &punchConn{
+		conn:  conn,
+		stats: &tunnel.stats,
+	}
+	c.stats.socketsOpen.Add(1)
+	c.stats.sockets.Add(1)
+	c.stopClose = context.AfterFunc(ctx, c.close)
+	s := tunnel.ttl
+	if s.Packets <= 0 {
+		return c
+	}
+	ipConn := ipv4.NewConn(conn)
+	normal, err := ipConn.TTL()
+	if err != nil {
+		log.Debugf("get ttl err, %s\n", err)
+		return c
+	}
+	if err = ipConn.SetTTL(s.TTL); err != nil {
+		log.Debugf("set ttl err, %s\n", err)
+		return c
+	}
+	c.ipConn = ipConn
+	c.normal = normal
+	c.low.Store(int32(s.Packets))
+	return c
+}
+
+func (c *punchConn) write(addr *net.UDPAddr, msg *Message) error {
+	err := udpWrite(c.conn, addr, msg)
+	if err == nil {
+		c.stats.sent.Add(1)
+	}
+	if c.ipConn != nil && c.low.Add(-1) == 0 {
+		c.normalTTL()
+	}
+	return err
+}
+
+// normalTTL switches the socket back to its normal TTL.
+func (c *punchConn) normalTTL() {
+	if c.ipConn == nil {
+		return
+	}
+	c.restore.Do(func() {
+		if err := c.ipConn.SetTTL(c.normal); err != nil {
+			log.Debugf("restore ttl err, %s\n", err)
+		}
+	})
+}
+
+// reply answers a message from the remote. Hearing from the remote means both
+// NATs have a mapping, so the reply and everything after go out with the normal TTL.
+func (c *punchConn) reply(addr *net.UDPAddr, msg *Message) error {
+	c.normalTTL()
+	err := udpWrite(c.conn, addr, msg)
+	if err == nil {
+		c.stats.sent.Add(1)
+	}
+	return err
+}
+
+func (c *punchConn) read(ctx context.Context) (*Message, *net.UDPAddr, error) {
+	msg, addr, err := udpRead(ctx, c.conn)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+		return nil, nil, err
+	}
+	c.stats.received.Add(1)
+	return msg, addr, nil
+}
+
+// keep detaches the socket from its context so it survives the punching,
+// it reports false if the socket was already closed. The read deadline of
+// the punching is cleared, QUIC reads from the socket next.
+func (c *punchConn) keep() bool {
+	if !c.stopClose() {
+		return false
+	}
+	c.kept = true
+	c.stats.socketsOpen.Add(-1)
+	if err := c.conn.SetReadDeadline(time.Time{}); err != nil {
+		log.Debugf("clear read deadline err, %s\n", err)
+	}
+	return true
+}
+
+// close closes the socket once, a concurrent call returns after it is closed.
+func (c *punchConn) close() {
+	c.closeOnce.Do(func() {
+		if err := c.conn.Close(); err == nil {
+			c.stats.socketsOpen.Add(-1)
+		}
+	})
+}
+
+// release closes the socket unless it was kept. Closing on context done
+// runs in a goroutine of its own, release makes sure the socket is closed
+// when the strategy returns.
+func (c *punchConn) release() {
+	if !c.kept {
+		c.close()
+	}
+}
+
 func handshake(tunnel *Tunnel) chan error {
 	cDone := make(chan error, 1)
 	local := tunnel.localNAT
 	remote := tunnel.remoteNAT
 
-	if local.NATType != NATTypeSymmetric && remote.NATType != NATTypeSymmetric {
-		// both are not symmetric NAT
-		// handshake
-		go handshakeNonSymmetric(tunnel, cDone)
-	} else if local.NATType == NATTypeSymmetric {
-		// local is symmetric NAT
-		// select local port
-		go handshakeLocalSymmetric(tunnel, cDone)
-	} else if remote.NATType == NATTypeSymmetric {
-		// remote is symmetric NAT
-		// select remote port
-		go handshakeRemoteSymmetric(tunnel, cDone)
-	}
+	go func() {
+		// fire together with the remote, see punchStart
+		if err := waitPunchStart(tunnel.ctx, tunnel.punchAt); err != nil {
+			cDone <- err
+			return
+		}
+		ctx, cancel := context.WithTimeout(tunnel.ctx, timeout)
+		defer cancel()
+		go tunnel.stats.report(ctx)
+
+		var err error
+		if local.NATType != NATTypeSymmetric && remote.NATType != NATTypeSymmetric {
+			// both are not symmetric NAT
+			// handshake
+			err = handshakeNonSymmetric(ctx, tunnel)
+		} else if local.NATType == NATTypeSymmetric {
+			// local is symmetric NAT
+			// select local port
+			err = handshakeLocalSymmetric(ctx, tunnel)
+		} else if remote.NATType == NATTypeSymmetric {
+			// remote is symmetric NAT
+			// select remote port
+			err = handshakeRemoteSymmetric(ctx, tunnel)
+		}
+		if err != nil {
+			cDone <- fmt.Errorf("hole punch: %w", err)
+			return
+		}
+		close(cDone)
+	}()
 	return cDone
 }
 
-func handshakeLocalSymmetric(tunnel *Tunnel, done chan error) {
+// Every strategy below returns only after all of its goroutines exited and
+// all of its sockets, except the one handed to the tunnel, are closed.
+
+func handshakeLocalSymmetric(ctx context.Context, tunnel *Tunnel) error {
 	log.Debugln("handshake local symmetric ...")
+	setStrategy(tunnel, "local symmetric")
 	remote := tunnel.remoteNAT
-	local := tunnel.localNAT
 	remoteAddr, err := net.ResolveUDPAddr("udp4", remote.Addr)
 	if err != nil {
-		done <- err
-		return
+		return err
 	}
-	c := make(chan *net.UDPAddr, 1)
-	stopChan := make(chan int, 1)
-	var selected int32 = 0
+	concurrency := tunnel.punchConcurrency
+	if concurrency <= 0 || concurrency > triesNum {
+		concurrency = triesNum
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	c := make(chan *net.UDPConn, 1)
+	sem := make(chan struct{}, concurrency)
 	// birthday attack
-	for i := 0; i < triesNum; i++ {
-		time.Sleep(time.Millisecond)
-		go func() {
-			conn, err := net.ListenUDP("udp4", nil)
-			if err != nil {
-				log.Debugf("udp listen err, %s\n", err)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < triesNum; i++ {
+			select {
+			case <-ctx.Done():
 				return
+			case sem <- struct{}{}:
 			}
-			defer func() {
-				_ = conn.Close()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-sem }()
+				conn := punchSocket(ctx, tunnel, remoteAddr)
+				if conn == nil {
+					return
+				}
+				// only select the first one
+				select {
+				case c <- conn:
+					cancel()
+				default:
+					_ = conn.Close()
+				}
 			}()
-			// send handshake
-			err = udpWrite(conn, remoteAddr, NewHandshakeMessage(local.Token))
-			if err != nil {
+			select {
+			case <-ctx.Done():
 				return
+			case <-time.After(time.Millisecond):
 			}
-			// rev response
-			msg, _, err := udpRead(conn)
-			if err != nil {
-				return
-			}
-			if msg.token != remote.Token {
-				log.Debugf("token fail, token: %s\n", msg.token)
-				return
-			}
-			// only select the first one
-			if !atomic.CompareAndSwapInt32(&selected, 0, 1) {
-				return
-			}
-			localAddr := conn.LocalAddr().(*net.UDPAddr)
-			// ensure conn is closed
-			_ = conn.Close()
-			close(stopChan)
-			c <- localAddr
-		}()
-	}
+		}
+	}()
+
+	// the spawner is done and every socket expired, nothing can punch
+	// through anymore
+	expired := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(expired)
+	}()
+
+	var conn *net.UDPConn
+	err = errPunchExpired
 	select {
-	case <-time.After(timeout):
-		done <- fmt.Errorf("timeout")
-	case localAddr := <-c:
-		conn, err := net.ListenUDP("udp4", localAddr)
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-expired:
+	case conn = <-c:
+	}
+	// wait for all other sockets to be closed
+	cancel()
+	<-expired
+	if conn == nil {
+		// the winner cancels ctx too, it may have come first
+		select {
+		case conn = <-c:
+		default:
+			return err
+		}
+	}
+	tunnel.conn = conn
+	tunnel.remoteAddr = *remoteAddr
+	return nil
+}
+
+// punchSocket runs the three-way handshake on a fresh socket and returns the
+// socket on success, kept open with its punched mapping. Otherwise the socket
+// is closed on return.
+func punchSocket(ctx context.Context, tunnel *Tunnel, remoteAddr *net.UDPAddr) *net.UDPConn {
+	local := tunnel.localNAT
+	remote := tunnel.remoteNAT
+	udpConn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		log.Debugf("udp listen err, %s\n", err)
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, socketLifetime)
+	defer cancel()
+	conn := newPunchConn(ctx, tunnel, udpConn)
+	defer conn.release()
+	// send handshake
+	if err = conn.write(remoteAddr, NewHandshakeMessage(local.Token)); err != nil {
+		return nil
+	}
+	// rev response until both directions are proven
+	for {
+		msg, src, err := conn.read(ctx)
 		if err != nil {
-			done <- err
-			return
+			return nil
+		}
+		if msg.token != remote.Token {
+			log.Debugf("token fail, token: %s\n", msg.token)
+			continue
+		}
+		reply, confirmed := handshakeReply(local.Token, msg.mType)
+		if reply != nil {
+			_ = conn.reply(src, reply)
+		}
+		if confirmed {
+			if !conn.keep() {
+				return nil
+			}
+			return udpConn
 		}
-		tunnel.conn = conn
-		tunnel.remoteAddr = *remoteAddr
-		close(done)
 	}
 }
 
-func handshakeRemoteSymmetric(tunnel *Tunnel, done chan error) {
+func handshakeRemoteSymmetric(ctx context.Context, tunnel *Tunnel) error {
 	log.Debugln("handshake remote symmetric ...")
+	setStrategy(tunnel, "remote symmetric")
 	remote := tunnel.remoteNAT
 	local := tunnel.localNAT
 	candidates := candidateAddrs(remote)
 
-	conn, err := net.ListenUDP("udp4", &tunnel.localAddr)
+	udpConn, err := net.ListenUDP("udp4", &tunnel.localAddr)
 	if err != nil {
-		done <- err
-		return
+		return err
 	}
 
-	stopChan := make(chan struct{})
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	conn := newPunchConn(ctx, tunnel, udpConn)
+	defer conn.release()
+
 	// spray handshakes at all candidates concurrently on the same conn
 	for _, baseAddr := range candidates {
 		baseAddr := baseAddr
+		wg.Add(1)
 		go func() {
+			defer wg.Done()
 			r := rand.New(rand.NewSource(time.Now().UnixNano()))
 			randPorts := r.Perm(65535)
 			for i := 0; i < triesNum; i++ {
-				time.Sleep(time.Millisecond)
 				select {
-				case <-stopChan:
+				case <-ctx.Done():
 					return
-				default:
-					dst := &net.UDPAddr{IP: baseAddr.IP, Port: randPorts[i]}
-					_ = udpWrite(conn, dst, NewHandshakeMessage(local.Token))
+				case <-time.After(time.Millisecond):
+					dst := &net.UDPAddr{IP: baseAddr.IP, Port: randPorts[i] + 1}
+					_ = conn.write(dst, NewHandshakeMessage(local.Token))
 				}
 			}
 		}()
 	}
 
 	for {
-		msg, dst, err := udpRead(conn)
+		msg, dst, err := conn.read(ctx)
 		if err != nil {
-			close(stopChan)
-			conn.Close()
-			done <- err
-			return
+			return err
 		}
 		if msg.token != remote.Token {
 			continue
 		}
-		close(stopChan)
-		_ = udpWrite(conn, dst, NewHandshakeMessage(local.Token))
-		tunnel.conn = conn
+		reply, confirmed := handshakeReply(local.Token, msg.mType)
+		if reply != nil {
+			_ = conn.reply(dst, reply)
+		}
+		if !confirmed {
+			continue
+		}
+		if !conn.keep() {
+			return ctx.Err()
+		}
+		tunnel.conn = udpConn
 		tunnel.remoteAddr = *dst
-		close(done)
-		return
+		return nil
 	}
 }
 
-func handshakeNonSymmetric(tunnel *Tunnel, done chan error) {
+func handshakeNonSymmetric(ctx context.Context, tunnel *Tunnel) error {
+	setStrategy(tunnel, "non symmetric")
 	remote := tunnel.remoteNAT
 	local := tunnel.localNAT
 	candidates := candidateAddrs(remote)
 
-	conn, err := net.ListenUDP("udp4", &tunnel.localAddr)
+	udpConn, err := net.ListenUDP("udp4", &tunnel.localAddr)
 	if err != nil {
-		done <- err
-		return
+		return err
 	}
 
-	stopChan := make(chan struct{})
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	conn := newPunchConn(ctx, tunnel, udpConn)
+	defer conn.release()
+
 	// keep sending handshake to all candidates until we get a response
 	for _, addr := range candidates {
 		addr := addr
+		wg.Add(1)
 		go func() {
+			defer wg.Done()
+			tick := time.NewTicker(200 * time.Millisecond)
+			defer tick.Stop()
 			for {
+				if err := conn.write(addr, NewHandshakeMessage(local.Token)); err != nil {
+					log.Debugf("write err for %s: %s\n", addr, err)
+				}
 				select {
-				case <-stopChan:
+				case <-ctx.Done():
 					return
-				default:
-					if err := udpWrite(conn, addr, NewHandshakeMessage(local.Token)); err != nil {
-						log.Debugf("write err for %s: %s\n", addr, err)
-					}
-					time.Sleep(200 * time.Millisecond)
+				case <-tick.C:
 				}
 			}
 		}()
 	}
 
-	// read loop: reply to first handshake received, then wait for the reply-ack
-	var remoteAddr *net.UDPAddr
+	// read loop: answer handshakes until both directions are proven
 	for {
-		msg, src, err := udpRead(conn)
+		msg, src, err := conn.read(ctx)
 		if err != nil {
-			close(stopChan)
-			conn.Close()
 			log.Debugf("udp read err, %s\n", err)
-			done <- err
-			return
+			return err
 		}
 		if msg.token != remote.Token {
 			continue
 		}
-		if remoteAddr == nil {
-			// first valid handshake received — reply so the other side can finish
-			remoteAddr = src
-			_ = udpWrite(conn, src, NewHandshakeMessage(local.Token))
+		reply, confirmed := handshakeReply(local.Token, msg.mType)
+		if reply != nil {
+			_ = conn.reply(src, reply)
 		}
-		// once we've sent our reply (or received theirs), we're done
-		close(stopChan)
-		tunnel.conn = conn
-		tunnel.remoteAddr = *remoteAddr
-		close(done)
-		return
+		if !confirmed {
+			continue
+		}
+		if !conn.keep() {
+			return ctx.Err()
+		}
+		tunnel.conn = udpConn
+		tunnel.remoteAddr = *src
+		return nil
+	}
+}
+
+func setStrategy(tunnel *Tunnel, strategy string) {
+	tunnel.stats.strategy.Store(&strategy)
+}
+
+// handshakeReply implements the three-way handshake shared by all strategies.
+// It returns the message to answer mType with, and whether receiving mType
+// proves the path works in both directions:
+//
+//	HANDSHAKE     -> reply HANDSHAKE-ACK, their packets reach us
+//	HANDSHAKE-ACK -> reply CONFIRM, done: our handshake reached them and their ack reached us
+//	CONFIRM       -> done: they received our ack
+//
+// A lost CONFIRM is recovered after completion: the remote keeps sending
+// handshakes, which migratingConn keeps answering.
+func handshakeReply(token string, mType MessageType) (*Message, bool) {
+	switch mType {
+	case MessageTypeHandshake:
+		return NewHandshakeAckMessage(token), false
+	case MessageTypeHandshakeAck:
+		return NewConfirmMessage(token), true
+	case MessageTypeConfirm:
+		return nil, true
 	}
+	return nil, false
 }
 
 // candidateAddrs returns all addresses to try for the remote peer:
@@ -237,19 +582,29 @@ func udpWrite(conn *net.UDPConn, addr *net.UDPAddr, msg *Message) error {
 	return nil
 }
 
-func udpRead(conn *net.UDPConn) (*Message, *net.UDPAddr, error) {
-	err := conn.SetReadDeadline(time.Now().Add(timeout))
-	if err != nil {
-		return nil, nil, err
+// udpRead returns the next tunnel message, packets that are not tunnel
+// messages (e.g. early QUIC packets from a peer that already finished) are skipped.
+// The read gives up at the deadline of ctx.
+func udpRead(ctx context.Context, conn *net.UDPConn) (*Message, *net.UDPAddr, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(timeout)
 	}
-	bytes := make([]byte, 128)
-	n, dst, err := conn.ReadFrom(bytes)
+	err := conn.SetReadDeadline(deadline)
 	if err != nil {
 		return nil, nil, err
 	}
-	msg, err := UnmarshalMessage(bytes[:n])
-	if err != nil {
-		return nil, nil, err
+	bytes := make([]byte, 128)
+	for {
+		n, dst, err := conn.ReadFrom(bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		msg, err := UnmarshalMessage(bytes[:n])
+		if err != nil {
+			log.Debugf("skip packet from %s: %s\n", dst, err)
+			continue
+		}
+		return msg, dst.(*net.UDPAddr), nil
 	}
-	return msg, dst.(*net.UDPAddr), nil
 }
@@ -0,0 +1,99 @@
+//go:build linux
+
+package tunnel
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+)
+
+// socketTTL reads IP_TTL straight from the socket.
+func socketTTL(t *testing.T, conn *net.UDPConn) int {
+	t.Helper()
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ttl int
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		ttl, sockErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TTL)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sockErr != nil {
+		t.Fatal(sockErr)
+	}
+	return ttl
+}
+
+func TestTTLStrategy(t *testing.T) {
+	tests := []struct {
+		name string
+		ttl  TTLStrategy
+		// what is sent before the TTL is checked again
+		send func(c *punchConn, addr *net.UDPAddr) error
+		// how many sends leave the low TTL in place
+		lowSends int
+	}{
+		{
+			name: "restored after the low packets",
+			ttl:  TTLStrategy{TTL: 3, Packets: 2},
+			send: func(c *punchConn, addr *net.UDPAddr) error {
+				return c.write(addr, NewHandshakeMessage(tokenA))
+			},
+			lowSends: 1,
+		},
+		{
+			name: "restored by a reply",
+			ttl:  TTLStrategy{TTL: 3, Packets: 5},
+			send: func(c *punchConn, addr *net.UDPAddr) error {
+				return c.reply(addr, NewHandshakeAckMessage(tokenA))
+			},
+		},
+		{
+			name: "disabled",
+			ttl:  TTLStrategy{TTL: 3},
+			send: func(c *punchConn, addr *net.UDPAddr) error {
+				return c.write(addr, NewHandshakeMessage(tokenA))
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, remote := listenLoopback(t), listenLoopback(t)
+			addr := remote.LocalAddr().(*net.UDPAddr)
+			normal := socketTTL(t, conn)
+			if normal == tt.ttl.TTL {
+				t.Fatalf("default ttl is the low ttl %d", normal)
+			}
+			pc := newPunchConn(context.Background(), &Tunnel{ttl: tt.ttl}, conn)
+			defer pc.stopClose()
+
+			want := normal
+			if tt.ttl.Packets > 0 {
+				want = tt.ttl.TTL
+			}
+			if got := socketTTL(t, conn); got != want {
+				t.Fatalf("ttl %d, want %d", got, want)
+			}
+			for i := 0; i < tt.lowSends; i++ {
+				if err := tt.send(pc, addr); err != nil {
+					t.Fatal(err)
+				}
+				if got := socketTTL(t, conn); got != tt.ttl.TTL {
+					t.Fatalf("ttl %d after %d packets, want %d", got, i+1, tt.ttl.TTL)
+				}
+			}
+			if err := tt.send(pc, addr); err != nil {
+				t.Fatal(err)
+			}
+			if got := socketTTL(t, conn); got != normal {
+				t.Fatalf("ttl %d, want %d restored", got, normal)
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// reservePort returns a loopback address free to bind.
+func reservePort(t *testing.T) net.UDPAddr {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := *conn.LocalAddr().(*net.UDPAddr)
+	_ = conn.Close()
+	return addr
+}
+
+// lossyLink forwards tunnel messages between a and b, drop decides which
+// get lost. It returns the addresses a and b reach each other at.
+func lossyLink(t *testing.T, a, b *net.UDPAddr, drop func(toB bool, msg *Message) bool) (forA, forB *net.UDPAddr) {
+	t.Helper()
+	toB, toA := listenLoopback(t), listenLoopback(t)
+	forward := func(in, out *net.UDPConn, dst *net.UDPAddr, towardsB bool) {
+		buf := make([]byte, 1500)
+		for {
+			n, _, err := in.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if msg, err := UnmarshalMessage(buf[:n]); err == nil && drop(towardsB, msg) {
+				continue
+			}
+			_, _ = out.WriteTo(buf[:n], dst)
+		}
+	}
+	go forward(toB, toA, b, true)
+	go forward(toA, toB, a, false)
+	return toB.LocalAddr().(*net.UDPAddr), toA.LocalAddr().(*net.UDPAddr)
+}
+
+func punchTunnel(ctx context.Context, local net.UDPAddr, localToken, remoteToken string, remote *net.UDPAddr) *Tunnel {
+	return &Tunnel{
+		ctx:       ctx,
+		localAddr: local,
+		localNAT:  &NATDetail{Token: localToken},
+		remoteNAT: &NATDetail{Token: remoteToken, Addr: remote.String()},
+	}
+}
+
+// TestHandshakeLostConfirm punches two peers through a link that loses the
+// first CONFIRM. The peer that completed answers the other's handshakes
+// from its migratingConn, so the other completes on the replayed ACK.
+func TestHandshakeLostConfirm(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	aAddr, bAddr := reservePort(t), reservePort(t)
+	// a's handshakes get lost until b completed and its CONFIRM got lost,
+	// so a can only complete on an ACK of b's migratingConn
+	var confirmLost atomic.Bool
+	lost := make(chan struct{})
+	forA, forB := lossyLink(t, &aAddr, &bAddr, func(toB bool, msg *Message) bool {
+		if toB {
+			return msg.mType == MessageTypeHandshake && !confirmLost.Load()
+		}
+		if msg.mType == MessageTypeConfirm && !confirmLost.Load() {
+			confirmLost.Store(true)
+			close(lost)
+			return true
+		}
+		return false
+	})
+	a := punchTunnel(ctx, aAddr, tokenA, tokenB, forA)
+	b := punchTunnel(ctx, bAddr, tokenB, tokenA, forB)
+
+	errA := make(chan error, 1)
+	go func() { errA <- handshakeNonSymmetric(ctx, a) }()
+	if err := handshakeNonSymmetric(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+	defer b.conn.Close()
+	select {
+	case <-lost:
+	case <-time.After(5 * time.Second):
+		t.Fatal("b completed without sending CONFIRM")
+	}
+	// what punchUDP hands QUIC
+	mb := newMigratingConn(b.conn.(*net.UDPConn), b.remoteAddr, tokenB, tokenA)
+	_ = readPackets(mb)
+
+	if err := <-errA; err != nil {
+		t.Fatal(err)
+	}
+	defer a.conn.Close()
+	if !udpAddrEqual(&a.remoteAddr, forA) || !udpAddrEqual(&b.remoteAddr, forB) {
+		t.Fatalf("remote addrs %s, %s, want %s, %s", &a.remoteAddr, &b.remoteAddr, forA, forB)
+	}
+}
+
+// TestHandshakeThreeWay punches two peers directly, both complete and keep
+// the socket facing the other.
+func TestHandshakeThreeWay(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	aAddr, bAddr := reservePort(t), reservePort(t)
+	a := punchTunnel(ctx, aAddr, tokenA, tokenB, &bAddr)
+	b := punchTunnel(ctx, bAddr, tokenB, tokenA, &aAddr)
+
+	errs := make(chan error, 2)
+	for _, tunnel := range []*Tunnel{a, b} {
+		go func() { errs <- handshakeNonSymmetric(ctx, tunnel) }()
+	}
+	for range 2 {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer a.conn.Close()
+	defer b.conn.Close()
+	if !udpAddrEqual(&a.remoteAddr, &bAddr) || !udpAddrEqual(&b.remoteAddr, &aAddr) {
+		t.Fatalf("remote addrs %s, %s", &a.remoteAddr, &b.remoteAddr)
+	}
+	if _, err := a.conn.WriteTo([]byte("quic"), &a.remoteAddr); err != nil {
+		t.Fatal(err)
+	}
+	// late handshake messages may still be queued in front
+	buf := make([]byte, 128)
+	for {
+		n, _, err := b.conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = UnmarshalMessage(buf[:n]); err == nil {
+			continue
+		}
+		if string(buf[:n]) != "quic" {
+			t.Fatalf("read %q", buf[:n])
+		}
+		return
+	}
+}
+
+func TestHandshakeLocalSymmetric(t *testing.T) {
+	tests := []struct {
+		name string
+		// answer runs the remote on addr until ctx is done
+		answer  func(ctx context.Context, t *testing.T, addr net.UDPAddr) error
+		cancel  time.Duration
+		wantErr error
+		// within bounds how long giving up may take
+		within time.Duration
+	}{
+		{
+			name: "punched",
+			answer: func(ctx context.Context, t *testing.T, addr net.UDPAddr) error {
+				remote := punchTunnel(ctx, addr, tokenB, tokenA, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1})
+				remote.remoteNAT.NATType = NATTypeSymmetric
+				err := handshakeRemoteSymmetric(ctx, remote)
+				if err == nil {
+					_ = remote.conn.Close()
+				}
+				return err
+			},
+		},
+		{
+			// every socket lives socketLifetime, there is no point in
+			// waiting for the full timeout
+			name:    "expired",
+			wantErr: errPunchExpired,
+			within:  timeout / 2,
+		},
+		{
+			name:    "canceled",
+			cancel:  200 * time.Millisecond,
+			wantErr: context.Canceled,
+			within:  2 * time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			remoteAddr := reservePort(t)
+			remoteErr := make(chan error, 1)
+			if tt.answer != nil {
+				go func() { remoteErr <- tt.answer(ctx, t, remoteAddr) }()
+			} else {
+				// a remote that never answers
+				_ = listenLoopback(t)
+				close(remoteErr)
+			}
+			if tt.cancel > 0 {
+				time.AfterFunc(tt.cancel, cancel)
+			}
+			tunnel := punchTunnel(ctx, net.UDPAddr{}, tokenA, tokenB, &remoteAddr)
+			start := time.Now()
+			err := handshakeLocalSymmetric(ctx, tunnel)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("handshake: %v, want %v", err, tt.wantErr)
+			}
+			if tt.within > 0 && time.Since(start) > tt.within {
+				t.Fatalf("gave up after %s", time.Since(start))
+			}
+			if err == nil {
+				_ = tunnel.conn.Close()
+				if !udpAddrEqual(&tunnel.remoteAddr, &remoteAddr) {
+					t.Fatalf("remote addr %s, want %s", &tunnel.remoteAddr, &remoteAddr)
+				}
+				if err = <-remoteErr; err != nil {
+					t.Fatalf("remote: %v", err)
+				}
+			}
+			if open := tunnel.PunchStats().SocketsOpen; open != 0 {
+				t.Fatalf("%d sockets left open", open)
+			}
+		})
+	}
+}
@@ -3,10 +3,10 @@ package tunnel
 import (
 	"context"
 	"crypto/tls"
-	"fmt"
 	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
 
 	"github.com/quic-go/quic-go"
 	"golang.org/x/net/http2"
@@ -31,6 +31,11 @@ func newQuicStreamConn(stream quic.Stream, conn quic.Connection) *quicStreamConn
 func (c *quicStreamConn) LocalAddr() net.Addr  { return c.localAddr }
 func (c *quicStreamConn) RemoteAddr() net.Addr { return c.remoteAddr }
 
+// CloseWrite closes the send direction only, the remote reads EOF.
+func (c *quicStreamConn) CloseWrite() error {
+	return c.Stream.Close()
+}
+
 func (c *quicStreamConn) Close() error {
 	c.Stream.CancelRead(0)
 	return c.Stream.Close()
@@ -85,20 +90,94 @@ func (l *quicStreamListener) Close() error {
 
 func (l *quicStreamListener) Addr() net.Addr { return l.session.LocalAddr() }
 
-// Peer represents an established P2P HTTP/2 connection.
+// Peer represents an established P2P HTTP/2 or HTTP/3 connection.
 // Both sides can register handlers and send requests — the roles are symmetric.
 type Peer struct {
 	// Client sends HTTP/2 requests to the remote peer.
 	Client *http.Client
 
+	tr  transport
 	srv *http.Server
 	ln  net.Listener
-	mux *http.ServeMux
+	// mux holds the routes of Handle and Expose, handler gets the requests
+	// none matches, chain wraps both in middleware. internal holds the
+	// reserved routes by exact path, they skip middleware.
+	mux        *http.ServeMux
+	internal   map[string]http.HandlerFunc
+	handlerMu  sync.RWMutex
+	handler    http.Handler
+	middleware []Middleware
+	chain      http.Handler
+
+	streamMu       sync.RWMutex
+	streamHandlers map[string]func(*Stream)
+	streams        chan *Stream
+	// h2conns receives the inbound streams carrying HTTP/2, nil with HTTP/3.
+	h2conns chan net.Conn
+	// done is closed once the Peer is gone, err tells why.
+	done     chan struct{}
+	doneOnce sync.Once
+	err      error
+	// closing is closed when Shutdown or Close starts, inflight counts the
+	// requests being served.
+	closing     chan struct{}
+	closingOnce sync.Once
+	reqMu       sync.Mutex
+	inflight    sync.WaitGroup
+	goAway      func(ctx context.Context) error
+	closeHTTP   func()
+
+	forwardMu      sync.RWMutex
+	forwardAllow   []string
+	listenAllow    []string
+	reverseTargets map[string]string
+	reverseID      atomic.Uint64
+
+	datagrams     chan []byte
+	datagramsDone chan struct{}
+	flowMu        sync.Mutex
+	flows         map[uint64]*udpFlow
+	flowID        atomic.Uint64
+
+	channelMu       sync.RWMutex
+	channelHandlers map[string]func(*Channel)
+
+	pingMu           sync.Mutex
+	pingStats        Stats
+	pingID           atomic.Uint64
+	livenessInterval atomic.Int64
+	livenessTimeout  atomic.Int64
+	livenessChanged  chan struct{}
 }
 
-// Handle registers a handler on the local HTTP/2 server (served to the remote peer).
-func (p *Peer) Handle(pattern string, handler http.HandlerFunc) {
-	p.mux.HandleFunc(pattern, handler)
+func newPeer(tr transport) *Peer {
+	p := &Peer{
+		tr:              tr,
+		mux:             http.NewServeMux(),
+		internal:        map[string]http.HandlerFunc{},
+		streamHandlers:  map[string]func(*Stream){},
+		streams:         make(chan *Stream),
+		done:            make(chan struct{}),
+		closing:         make(chan struct{}),
+		livenessChanged: make(chan struct{}, 1),
+		reverseTargets:  map[string]string{},
+		datagrams:       make(chan []byte, 64),
+		datagramsDone:   make(chan struct{}),
+		flows:           map[uint64]*udpFlow{},
+		channelHandlers: map[string]func(*Channel){},
+	}
+	p.handleStream(forwardProtocol, p.serveForward)
+	p.handleStream(listenProtocol, p.serveListen)
+	p.handleStream(reverseProtocol, p.serveReverse)
+	p.handleStream(udpProtocol, p.serveUDP)
+	p.handleStream(pingProtocol, p.servePing)
+	p.handleStream(channelProtocol, p.serveChannel)
+	p.internal[proxyPath] = p.serveProxy
+	p.chain = http.HandlerFunc(p.route)
+	p.SetLiveness(livenessInterval, livenessTimeout)
+	go p.receiveDatagrams()
+	go p.checkLiveness()
+	return p
 }
 
 func (p *Peer) serve() {
@@ -106,132 +185,84 @@ func (p *Peer) serve() {
 }
 
 // ConnectHTTP2 establishes a symmetric HTTP/2 connection over the P2P tunnel.
-// Both sides concurrently open a stream (for sending) and accept a stream (for receiving).
-// No role negotiation needed — each side uses its own outbound stream as the HTTP/2
-// client transport, and serves inbound streams with h2c.
+// No role negotiation needed — each side sends its requests on HTTP/2
+// connections it opens as streams, and serves the ones the remote opens with h2c.
 func (t *Tunnel) ConnectHTTP2() (*Peer, error) {
-	qw := upgrade(t)
-	return qw.connectHTTP2()
-}
-
-func (q *QuicWrapper) connectHTTP2() (*Peer, error) {
-	ctx := q.ctx
-
-	// Establish QUIC connection: token-greater peer dials, other listens.
-	// This is only to get a single shared QUIC connection — HTTP/2 roles are symmetric.
-	session, err := q.quicConnect(ctx)
+	tr, err := t.connectTransport()
 	if err != nil {
 		return nil, err
 	}
+	return newHTTP2Peer(t.ctx, tr), nil
+}
 
-	mux := http.NewServeMux()
+// newHTTP2Peer sets up symmetric HTTP/2 over the streams of tr. The client
+// opens a stream for a new HTTP/2 connection whenever it has none usable,
+// e.g. after the remote sent GOAWAY, and the server serves every inbound one.
+func newHTTP2Peer(ctx context.Context, tr transport) *Peer {
 	h2srv := &http2.Server{}
-	srv := &http.Server{Handler: h2c.NewHandler(mux, h2srv)}
-
-	// Each peer opens one stream and accepts one stream.
-	// OpenStreamSync + NewClientConn must run concurrently with AcceptStream:
-	// NewClientConn writes the HTTP/2 preface immediately, which sends the first
-	// STREAM frame and unblocks the peer's AcceptStream.
-	type streamResult struct {
-		stream quic.Stream
-		err    error
+	peer := newPeer(tr)
+	peer.srv = &http.Server{Handler: h2c.NewHandler(http.HandlerFunc(peer.serveHTTP), h2srv)}
+	// lets Shutdown of srv send GOAWAY on the connections h2c hijacks
+	if err := http2.ConfigureServer(peer.srv, h2srv); err != nil {
+		log.Debugf("configure http2 server error: %s\n", err)
 	}
-	type ccResult struct {
-		cc  *http2.ClientConn
-		err error
+	peer.h2conns = make(chan net.Conn)
+	go peer.acceptStreams(ctx)
+
+	h2tr := &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+			conn, err := tr.OpenStream(ctx)
+			if err != nil {
+				return nil, err
+			}
+			if err = writeStreamHeader(conn, http2Protocol); err != nil {
+				_ = conn.Close()
+				return nil, err
+			}
+			return conn, nil
+		},
 	}
-	ccCh := make(chan ccResult, 1)
-	acceptCh := make(chan streamResult, 1)
-
-	go func() {
-		s, err := session.OpenStreamSync(ctx)
-		if err != nil {
-			ccCh <- ccResult{err: err}
-			return
-		}
-		conn := newQuicStreamConn(s, session)
-		cc, err := (&http2.Transport{}).NewClientConn(conn)
-		if err != nil {
-			conn.Close()
-		}
-		ccCh <- ccResult{cc: cc, err: err}
-	}()
-
-	go func() {
-		s, err := session.AcceptStream(ctx)
-		acceptCh <- streamResult{s, err}
-	}()
-
-	ccRes := <-ccCh
-	if ccRes.err != nil {
-		session.CloseWithError(0, "")
-		return nil, fmt.Errorf("open stream: %w", ccRes.err)
+	peer.Client = &http.Client{Transport: h2tr}
+	peer.ln = &streamListener{
+		conns:  peer.h2conns,
+		done:   peer.done,
+		addr:   tr.LocalAddr(),
+		closed: make(chan struct{}),
 	}
-	acceptRes := <-acceptCh
-	if acceptRes.err != nil {
-		session.CloseWithError(0, "")
-		return nil, fmt.Errorf("accept stream: %w", acceptRes.err)
-	}
-
-	inConn := newQuicStreamConn(acceptRes.stream, session)
-	inLn := &oneShotListener{conn: inConn, done: make(chan struct{})}
-
-	peer := &Peer{
-		Client: &http.Client{Transport: ccRes.cc},
-		srv:    srv,
-		ln:     inLn,
-		mux:    mux,
+	peer.goAway = peer.srv.Shutdown
+	peer.closeHTTP = func() {
+		_ = peer.srv.Close()
+		h2tr.CloseIdleConnections()
 	}
 	peer.serve()
-	return peer, nil
+	return peer
 }
 
-// quicConnect returns a QUIC session to the remote peer.
-// Token comparison deterministically assigns roles: greater token dials, lesser listens.
-// This ensures exactly one connection is established with unambiguous direction.
-func (q *QuicWrapper) quicConnect(ctx context.Context) (quic.Connection, error) {
-	localToken := q.tunnel.localNAT.Token
-	remoteToken := q.tunnel.remoteNAT.Token
-
-	if localToken > remoteToken {
-		return q.tr.Dial(ctx, &q.tunnel.remoteAddr, &tls.Config{
-			InsecureSkipVerify: true,
-			NextProtos:         []string{"h2", "tunnel"},
-		}, nil)
-	}
-
-	tlsCfg, err := generateTLSConfig()
-	if err != nil {
-		return nil, err
-	}
-	listener, err := q.tr.Listen(tlsCfg, nil)
-	if err != nil {
-		return nil, err
-	}
-	session, err := listener.Accept(ctx)
-	if err != nil {
-		listener.Close()
-		return nil, err
-	}
-	// Do not close listener — closing it terminates all accepted sessions.
-	return session, nil
+// streamListener hands the inbound HTTP/2 streams to the server until the
+// remote's streams are no longer accepted.
+type streamListener struct {
+	conns  <-chan net.Conn
+	done   <-chan struct{}
+	addr   net.Addr
+	once   sync.Once
+	closed chan struct{}
 }
 
-// oneShotListener serves exactly one pre-accepted net.Conn then returns ErrClosed.
-type oneShotListener struct {
-	conn net.Conn
-	once sync.Once
-	done chan struct{}
+func (l *streamListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
 }
 
-func (l *oneShotListener) Accept() (net.Conn, error) {
-	var c net.Conn
-	l.once.Do(func() { c = l.conn; close(l.done) })
-	if c != nil {
-		return c, nil
-	}
-	return nil, net.ErrClosed
+func (l *streamListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
 }
 
-func (l *oneShotListener) Close() error   { return nil }
-func (l *oneShotListener) Addr() net.Addr { return l.conn.LocalAddr() }
+func (l *streamListener) Addr() net.Addr { return l.addr }
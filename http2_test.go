@@ -0,0 +1,52 @@
+package tunnel
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"testing"
+)
+
+// TestGoAwayRedial has the server send GOAWAY after a response, the client
+// then opens a new HTTP/2 connection for the next request.
+func TestGoAwayRedial(t *testing.T) {
+	a, b := newPeerPair(t)
+	b.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/bye" {
+			// the HTTP/2 server turns this into GOAWAY
+			w.Header().Set("Connection", "close")
+		}
+		_, _ = io.WriteString(w, r.URL.Path)
+	})
+
+	get := func(path string) (reused bool) {
+		t.Helper()
+		trace := &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) { reused = info.Reused },
+		}
+		req, err := http.NewRequest(http.MethodGet, "https://tunnel"+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := a.Client.Do(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+		if err != nil {
+			t.Fatalf("GET %s: %s", path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if string(body) != path {
+			t.Fatalf("GET %s: body %q", path, body)
+		}
+		return reused
+	}
+
+	// every GOAWAY is answered with a new connection, which goes away again
+	for _, path := range []string{"/hello", "/again", "/last"} {
+		if get(path) {
+			t.Fatalf("GET %s reused a connection that went away", path)
+		}
+		if !get("/bye") {
+			t.Fatal("GET /bye opened a new connection")
+		}
+	}
+}
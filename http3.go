@@ -0,0 +1,144 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+var errHTTP3Unsupported = errors.New("http3 needs a QUIC connection")
+
+// ConnectHTTP3 runs HTTP/3 directly on the QUIC connection: every request
+// gets its own QUIC stream, so there is no head-of-line blocking between
+// requests. Like ConnectHTTP2 both sides are symmetric, each one serves the
+// requests the other sends on the same connection.
+//
+// It fails if Connect fell back to TCP, which has no QUIC connection.
+func (t *Tunnel) ConnectHTTP3() (*Peer, error) {
+	tr, err := t.connectTransport()
+	if err != nil {
+		return nil, err
+	}
+	qt, ok := tr.(*quicTransport)
+	if !ok {
+		_ = tr.Close()
+		return nil, errHTTP3Unsupported
+	}
+	return newHTTP3Peer(qt), nil
+}
+
+// http3Authority is the host every HTTP/3 request is sent to, so the
+// RoundTripper, which keeps a client per host, only ever has one.
+const http3Authority = "tunnel:443"
+
+// newHTTP3Peer serves and sends HTTP/3 on the connection of tr. The remote's
+// requests arrive on the bidirectional streams it opens, ours go out on the
+// ones we open; raw streams opened with OpenStream reach the server too and
+// are hijacked by their header.
+//
+// A connection has a single HTTP/3 endpoint in each direction (RFC 9114
+// section 6.2.1): the server opens our only control stream and owns the
+// unidirectional streams of the remote, the client is kept off both.
+func newHTTP3Peer(tr *quicTransport) *Peer {
+	peer := newPeer(tr)
+	srv := &http3.Server{
+		Handler:        http.HandlerFunc(peer.serveHTTP),
+		StreamHijacker: peer.streamHijacker,
+	}
+	go func() {
+		err := srv.ServeQUICConn(tr.conn)
+		if err != nil {
+			log.Debugf("http3 serve error: %s\n", err)
+		}
+		peer.finish(err)
+	}()
+	rt := &http3.RoundTripper{
+		Dial: func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+			return http3ClientConn{tr.conn}, nil
+		},
+	}
+	peer.Client = &http.Client{Transport: http3SingleClient{rt}}
+	peer.closeHTTP = func() {
+		_ = srv.Close()
+		_ = rt.Close()
+	}
+	return peer
+}
+
+// http3SingleClient sends every request through the same client of rt, the
+// Host header still carries the request's host.
+type http3SingleClient struct {
+	rt *http3.RoundTripper
+}
+
+func (c http3SingleClient) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host == http3Authority {
+		return c.rt.RoundTrip(req)
+	}
+	r := *req
+	u := *req.URL
+	u.Host = http3Authority
+	r.URL = &u
+	if r.Host == "" {
+		r.Host = req.URL.Host
+	}
+	return c.rt.RoundTrip(&r)
+}
+
+// http3ClientConn hands an established connection to the HTTP/3 client,
+// which expects one that may still be in its handshake. The control stream
+// the client opens is discarded and it accepts no unidirectional streams,
+// the server of the connection takes care of both.
+type http3ClientConn struct {
+	quic.Connection
+}
+
+var handshakeComplete = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
+
+func (c http3ClientConn) HandshakeComplete() <-chan struct{} { return handshakeComplete }
+func (c http3ClientConn) NextConnection() quic.Connection    { return c.Connection }
+
+func (c http3ClientConn) OpenUniStream() (quic.SendStream, error) {
+	return newDiscardStream(), nil
+}
+
+func (c http3ClientConn) OpenUniStreamSync(context.Context) (quic.SendStream, error) {
+	return newDiscardStream(), nil
+}
+
+func (c http3ClientConn) AcceptUniStream(ctx context.Context) (quic.ReceiveStream, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.Context().Done():
+		return nil, context.Cause(c.Context())
+	}
+}
+
+// discardStream is the control stream of the HTTP/3 client, nothing written
+// to it is sent.
+type discardStream struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newDiscardStream() *discardStream {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &discardStream{ctx: ctx, cancel: cancel}
+}
+
+func (s *discardStream) StreamID() quic.StreamID          { return -1 }
+func (s *discardStream) Write(b []byte) (int, error)      { return len(b), nil }
+func (s *discardStream) Close() error                     { s.cancel(); return nil }
+func (s *discardStream) CancelWrite(quic.StreamErrorCode) { s.cancel() }
+func (s *discardStream) Context() context.Context         { return s.ctx }
+func (s *discardStream) SetWriteDeadline(time.Time) error { return nil }
@@ -0,0 +1,71 @@
+package tunnel
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/quic-go/quic-go"
+)
+
+// uniCountingConn counts the unidirectional streams opened on a connection.
+type uniCountingConn struct {
+	quic.Connection
+	opened *atomic.Int32
+}
+
+func (c uniCountingConn) OpenUniStream() (quic.SendStream, error) {
+	c.opened.Add(1)
+	return c.Connection.OpenUniStream()
+}
+
+func (c uniCountingConn) OpenUniStreamSync(ctx context.Context) (quic.SendStream, error) {
+	c.opened.Add(1)
+	return c.Connection.OpenUniStreamSync(ctx)
+}
+
+// newHTTP3PeerPair runs HTTP/3 Peers over a loopback QUIC connection, the
+// returned counters count the unidirectional streams each one opened.
+func newHTTP3PeerPair(t *testing.T) (a, b *Peer, uniA, uniB *atomic.Int32) {
+	t.Helper()
+	ta, tb := newQuicPair(t)
+	uniA, uniB = &atomic.Int32{}, &atomic.Int32{}
+	ta.conn = uniCountingConn{ta.conn, uniA}
+	tb.conn = uniCountingConn{tb.conn, uniB}
+	a, b = newHTTP3Peer(ta), newHTTP3Peer(tb)
+	t.Cleanup(func() {
+		_ = a.Close()
+		_ = b.Close()
+	})
+	return a, b, uniA, uniB
+}
+
+func TestHTTP3(t *testing.T) {
+	a, b, uniA, uniB := newHTTP3PeerPair(t)
+	for _, p := range []*Peer{a, b} {
+		p.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, r.Proto+" "+r.Host)
+		})
+	}
+
+	// requests to any host go through the single client of the connection
+	for i, p := range []*Peer{a, b, a, b} {
+		for _, host := range []string{"tunnel", "tunnel:443", "api.internal"} {
+			resp, err := p.Client.Get("https://" + host + "/")
+			if err != nil {
+				t.Fatalf("peer %d, %s: %v", i%2, host, err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			if want := "HTTP/3.0 " + host; string(body) != want {
+				t.Fatalf("peer %d: got %q, want %q", i%2, body, want)
+			}
+		}
+	}
+	// only the control stream of the server, RFC 9114 allows one per side
+	if a, b := uniA.Load(), uniB.Load(); a != 1 || b != 1 {
+		t.Fatalf("opened %d and %d unidirectional streams, want 1 each", a, b)
+	}
+}
@@ -0,0 +1,109 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrPeerClosed is the Err of a Peer closed locally.
+var ErrPeerClosed = errors.New("peer closed")
+
+// shutdownLinger is how long Shutdown keeps the connection after the last
+// handler returned, so its response leaves before the connection closes.
+const shutdownLinger = time.Millisecond * 200
+
+// Done is closed when the Peer is gone: closed locally or the connection to
+// the remote was lost.
+func (p *Peer) Done() <-chan struct{} {
+	return p.done
+}
+
+// Err returns nil until Done is closed, then why: ErrPeerClosed after Close
+// or Shutdown, ErrPeerUnresponsive if the remote stopped answering pings,
+// otherwise the error that ended the connection.
+func (p *Peer) Err() error {
+	select {
+	case <-p.done:
+		return p.err
+	default:
+		return nil
+	}
+}
+
+// finish records err as the reason the Peer is gone, the first one wins.
+func (p *Peer) finish(err error) {
+	p.doneOnce.Do(func() {
+		if err == nil {
+			err = ErrPeerClosed
+		}
+		p.err = err
+		close(p.done)
+	})
+}
+
+// Shutdown stops the Peer gracefully: the remote is told to send no more
+// requests (GOAWAY with HTTP/2), new ones are refused with 503 and the ones
+// in flight may finish until ctx is done. Then the Peer is closed, the
+// returned error is ctx's if requests were still running.
+func (p *Peer) Shutdown(ctx context.Context) error {
+	p.reqMu.Lock()
+	p.closingOnce.Do(func() { close(p.closing) })
+	p.reqMu.Unlock()
+	if p.goAway != nil {
+		if err := p.goAway(ctx); err != nil {
+			log.Debugf("http shutdown error: %s\n", err)
+		}
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		p.inflight.Wait()
+		close(drained)
+	}()
+	var err error
+	select {
+	case <-drained:
+		select {
+		case <-time.After(shutdownLinger):
+		case <-ctx.Done():
+		}
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if cerr := p.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Close tears the Peer down immediately, requests in flight fail.
+func (p *Peer) Close() error {
+	return p.closeWith(ErrPeerClosed)
+}
+
+// closeWith closes the Peer with err as its Err.
+func (p *Peer) closeWith(err error) error {
+	p.reqMu.Lock()
+	p.closingOnce.Do(func() { close(p.closing) })
+	p.reqMu.Unlock()
+	p.finish(err)
+	if p.closeHTTP != nil {
+		p.closeHTTP()
+	}
+	return p.tr.Close()
+}
+
+// track counts a request as in flight for Shutdown, it reports false once the Peer
+// is shutting down.
+func (p *Peer) track() bool {
+	p.reqMu.Lock()
+	defer p.reqMu.Unlock()
+	select {
+	case <-p.closing:
+		return false
+	default:
+	}
+	p.inflight.Add(1)
+	return true
+}
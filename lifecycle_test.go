@@ -0,0 +1,169 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	for _, pp := range peerPairs {
+		t.Run(pp.name, func(t *testing.T) {
+			a, b := pp.pair(t)
+			started := make(chan struct{})
+			release := make(chan struct{})
+			b.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+				close(started)
+				<-release
+				fmt.Fprint(w, "done")
+			})
+			b.HandleFunc("/fast", func(w http.ResponseWriter, r *http.Request) {})
+
+			result := make(chan error, 1)
+			go func() {
+				resp, err := a.Client.Get("https://tunnel/slow")
+				if err != nil {
+					result <- err
+					return
+				}
+				defer resp.Body.Close()
+				body, err := io.ReadAll(resp.Body)
+				if err == nil && string(body) != "done" {
+					err = fmt.Errorf("body %q", body)
+				}
+				result <- err
+			}()
+			<-started
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			shutdown := make(chan error, 1)
+			go func() { shutdown <- b.Shutdown(ctx) }()
+
+			// new requests are refused while the slow one may finish
+			for {
+				resp, err := a.Client.Get("https://tunnel/fast")
+				if err != nil {
+					break
+				}
+				_ = resp.Body.Close()
+				if resp.StatusCode == http.StatusServiceUnavailable {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			close(release)
+			if err := <-result; err != nil {
+				t.Fatalf("request in flight: %s", err)
+			}
+			if err := <-shutdown; err != nil {
+				t.Fatal(err)
+			}
+			if !errors.Is(b.Err(), ErrPeerClosed) {
+				t.Fatalf("err %v, want %v", b.Err(), ErrPeerClosed)
+			}
+			select {
+			case <-a.Done():
+			case <-ctx.Done():
+				t.Fatal("remote still up after shutdown")
+			}
+		})
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	a, b := newPeerPair(t)
+	started := make(chan struct{})
+	b.HandleFunc("/stuck", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+	})
+	go func() {
+		if resp, err := a.Client.Get("https://tunnel/stuck"); err == nil {
+			_ = resp.Body.Close()
+		}
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := b.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("shutdown error %v, want %v", err, context.DeadlineExceeded)
+	}
+	select {
+	case <-b.Done():
+	default:
+		t.Fatal("peer not closed after shutdown")
+	}
+}
+
+// TestCloseReleasesSocket closes Peers on sockets punched for them, as
+// ConnectHTTP2 sets them up: the sockets are closed and the network is no
+// longer watched, while the Tunnel's context still runs.
+func TestCloseReleasesSocket(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ua, ub := listenLoopback(t), listenLoopback(t)
+	conns := []*migratingConn{
+		newMigratingConn(ua, *ub.LocalAddr().(*net.UDPAddr), tokenA, tokenB),
+		newMigratingConn(ub, *ua.LocalAddr().(*net.UDPAddr), tokenB, tokenA),
+	}
+	type result struct {
+		p       *Peer
+		err     error
+		watched chan struct{}
+	}
+	results := make(chan result, 2)
+	for i, conn := range conns {
+		local, remote := tokenA, tokenB
+		if i == 1 {
+			local, remote = remote, local
+		}
+		tunnel := &Tunnel{
+			ctx:        ctx,
+			conn:       conn,
+			remoteAddr: *conn.remoteAddr,
+			localNAT:   &NATDetail{Token: local},
+			remoteNAT:  &NATDetail{Token: remote},
+		}
+		go func() {
+			watched := make(chan struct{})
+			go func() {
+				defer close(watched)
+				tunnel.watchNetwork(conn)
+			}()
+			p, err := tunnel.ConnectHTTP2()
+			results <- result{p, err, watched}
+		}()
+	}
+	// both connect before either closes, the listening side completes the
+	// handshake only after the dialing one
+	var connected []result
+	for range conns {
+		r := <-results
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		connected = append(connected, r)
+	}
+	for _, r := range connected {
+		if err := r.p.Close(); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-r.watched:
+		case <-time.After(5 * time.Second):
+			t.Fatal("network still watched after close")
+		}
+	}
+	for _, c := range []*net.UDPConn{ua, ub} {
+		if _, err := c.WriteTo([]byte("x"), c.LocalAddr()); !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("write after close: %v, want %v", err, net.ErrClosed)
+		}
+	}
+}
@@ -17,6 +17,11 @@ const (
 	MessageTypeHandshake MessageType = iota + 1
 	MessageTypePing
 	MessageTypeData
+	MessageTypeMigrate
+	MessageTypeMigrateAck
+	MessageTypeHandshakeAck
+	MessageTypeConfirm
+	MessageTypeMigrateChallenge
 )
 
 type Message struct {
@@ -38,6 +43,28 @@ func NewHandshakeMessage(token string) *Message {
 	}
 }
 
+// NewHandshakeAckMessage answers a handshake, proving the sender's packets reach us.
+func NewHandshakeAckMessage(token string) *Message {
+	return &Message{
+		header:  magicHeader,
+		version: 1,
+		token:   token,
+		mType:   MessageTypeHandshakeAck,
+		len:     0,
+	}
+}
+
+// NewConfirmMessage answers a handshake ack, completing the three-way handshake.
+func NewConfirmMessage(token string) *Message {
+	return &Message{
+		header:  magicHeader,
+		version: 1,
+		token:   token,
+		mType:   MessageTypeConfirm,
+		len:     0,
+	}
+}
+
 func NewPingMessage(token string) *Message {
 	return &Message{
 		header:  magicHeader,
@@ -62,6 +89,53 @@ func NewDataMessage(token string, data []byte) *Message {
 	}
 }
 
+// NewMigrateMessage announces that the sender has rebound its socket after a
+// local network change. The payload carries the sender's new mapped address
+// and the MAC authenticating the announcement:
+//
+//	1 byte  address length
+//	n bytes address
+//	32 bytes MAC
+func NewMigrateMessage(token string, addr string, mac []byte) *Message {
+	payload := append([]byte{byte(len(addr))}, addr...)
+	payload = append(payload, mac...)
+	return &Message{
+		header:  magicHeader,
+		version: 1,
+		token:   token,
+		mType:   MessageTypeMigrate,
+		len:     uint16(len(payload)),
+		payload: payload,
+	}
+}
+
+// NewMigrateChallengeMessage asks the sender of a migrate message to prove
+// it receives on the address it sent from. The payload is the challenge
+// followed by the MAC of the challenger.
+func NewMigrateChallengeMessage(token string, challenge, mac []byte) *Message {
+	payload := append(append([]byte(nil), challenge...), mac...)
+	return &Message{
+		header:  magicHeader,
+		version: 1,
+		token:   token,
+		mType:   MessageTypeMigrateChallenge,
+		len:     uint16(len(payload)),
+		payload: payload,
+	}
+}
+
+// NewMigrateAckMessage confirms a migration, the payload is its MAC.
+func NewMigrateAckMessage(token string, mac []byte) *Message {
+	return &Message{
+		header:  magicHeader,
+		version: 1,
+		token:   token,
+		mType:   MessageTypeMigrateAck,
+		len:     uint16(len(mac)),
+		payload: mac,
+	}
+}
+
 func (m *Message) Marshal() ([]byte, error) {
 	token, err := hex.DecodeString(m.token)
 	if err != nil {
@@ -118,6 +192,9 @@ func UnmarshalMessage(bytes []byte) (*Message, error) {
 	cursor = cursor + 1
 	dataLen := binary.LittleEndian.Uint16(bytes[cursor : cursor+2])
 	cursor = cursor + 2
+	if len(bytes) < cursor+int(dataLen)+4 {
+		return nil, fmt.Errorf("message length not match, data invalid")
+	}
 	var payload []byte
 	if dataLen > 0 {
 		payload = bytes[cursor : cursor+int(dataLen)]
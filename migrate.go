@@ -0,0 +1,481 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// migrateTimeout bounds how long a new address is announced to the remote.
+const migrateTimeout = time.Second * 10
+
+// migratePunches is how many packets open our NAT towards a migrated remote,
+// it announces repeatedly, so a few per announcement are plenty.
+const migratePunches = 3
+
+// migrateKeyLabel is the TLS exporter label of the key authenticating
+// migration messages, see migrationKey.
+const migrateKeyLabel = "EXPORTER-tunnel-migrate"
+
+// migrateChallengeSize is the size of the challenge a migrating remote
+// has to answer from its new address.
+const migrateChallengeSize = 16
+
+// maxMigrateChallenges bounds the challenges waiting for an answer, one per
+// source address announcing a migration.
+const maxMigrateChallenges = 16
+
+var errMigrateNoKey = errors.New("migration unavailable before the QUIC handshake")
+
+// migrateDebounce is how long to wait for address events to settle,
+// interfaces usually emit a burst of them while being reconfigured.
+const migrateDebounce = time.Second
+
+// migratingConn is the net.PacketConn QUIC runs on once hole punching succeeded.
+// The underlying UDP socket can be swapped after a local network change, and
+// writes to the remote are redirected to the address it announced last, so the
+// QUIC connection on top keeps seeing the same addresses and survives the move.
+//
+// The tokens travel in clear in every punch packet, so migration is
+// authenticated with a key exported from the QUIC connection's TLS session
+// and the new address is validated before any packet goes there:
+//
+//	MIGRATE(addr, MAC(addr))                 -> from the new address
+//	MIGRATE-CHALLENGE(c, MAC(c))             <- to that address
+//	MIGRATE(addr, MAC(addr, c))              -> proves it receives there
+//	MIGRATE-ACK(MAC(c))                      <- remote switched
+//
+// Until the key is set migration messages are ignored.
+type migratingConn struct {
+	mu          sync.RWMutex
+	conn        *net.UDPConn
+	closed      bool
+	readBuffer  int
+	writeBuffer int
+
+	// remoteAddr is the address QUIC was connected to, currentAddr is where
+	// the remote can actually be reached now.
+	remoteAddr  *net.UDPAddr
+	currentAddr *net.UDPAddr
+
+	localToken  string
+	remoteToken string
+	acked       chan struct{}
+	challenged  chan struct{}
+	done        chan struct{}
+
+	// key authenticates migration messages. challenge is the last one the
+	// remote sent us while we announce, challenges are the ones we sent to
+	// announcing addresses.
+	key        []byte
+	challenge  []byte
+	challenges map[string][]byte
+}
+
+func newMigratingConn(conn *net.UDPConn, remoteAddr net.UDPAddr, localToken, remoteToken string) *migratingConn {
+	current := remoteAddr
+	return &migratingConn{
+		conn:        conn,
+		remoteAddr:  &remoteAddr,
+		currentAddr: &current,
+		localToken:  localToken,
+		remoteToken: remoteToken,
+		acked:       make(chan struct{}, 1),
+		challenged:  make(chan struct{}, 1),
+		done:        make(chan struct{}),
+		challenges:  map[string][]byte{},
+	}
+}
+
+// setKey enables migration with key, shared with the remote.
+func (c *migratingConn) setKey(key []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.key = key
+}
+
+// migrationKey derives the key authenticating migration messages from the
+// TLS session of conn, both sides derive the same one.
+func migrationKey(conn quic.Connection) ([]byte, error) {
+	state := conn.ConnectionState().TLS
+	return state.ExportKeyingMaterial(migrateKeyLabel, nil, sha256.Size)
+}
+
+// migrateMAC authenticates the parts of a migration message of kind, each
+// part is length prefixed so they can't be shifted into one another.
+func migrateMAC(key []byte, kind string, parts ...[]byte) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(kind))
+	for _, p := range parts {
+		m.Write([]byte{byte(len(p))})
+		m.Write(p)
+	}
+	return m.Sum(nil)
+}
+
+func (c *migratingConn) udpConn() *net.UDPConn {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.conn
+}
+
+// peerAddr returns the address the remote can currently be reached at.
+func (c *migratingConn) peerAddr() *net.UDPAddr {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.currentAddr
+}
+
+func (c *migratingConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		conn := c.udpConn()
+		n, addr, err := conn.ReadFromUDP(p)
+		if err != nil {
+			if conn != c.udpConn() {
+				// socket was swapped by rebind, continue on the new one
+				continue
+			}
+			return 0, nil, err
+		}
+		if c.handleControl(conn, p[:n], addr) {
+			continue
+		}
+		c.mu.RLock()
+		if udpAddrEqual(addr, c.currentAddr) {
+			addr = c.remoteAddr
+		}
+		c.mu.RUnlock()
+		return n, addr, nil
+	}
+}
+
+func (c *migratingConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mu.RLock()
+	if a, ok := addr.(*net.UDPAddr); ok && udpAddrEqual(a, c.remoteAddr) {
+		addr = c.currentAddr
+	}
+	conn := c.conn
+	c.mu.RUnlock()
+	n, err := conn.WriteTo(p, addr)
+	if err != nil && conn != c.udpConn() {
+		// socket was swapped by rebind, retry on the new one
+		return c.udpConn().WriteTo(p, addr)
+	}
+	return n, err
+}
+
+// handleControl consumes tunnel control messages so they never reach QUIC,
+// late handshake messages are answered so the remote can complete.
+// It reports whether the packet was consumed.
+func (c *migratingConn) handleControl(conn *net.UDPConn, b []byte, addr *net.UDPAddr) bool {
+	msg, err := UnmarshalMessage(b)
+	if err != nil {
+		return false
+	}
+	if msg.token != c.remoteToken {
+		log.Debugf("received message with unexpected token: %s\n", msg.token)
+		return true
+	}
+	switch msg.mType {
+	case MessageTypeHandshake, MessageTypeHandshakeAck, MessageTypeConfirm:
+		// the remote may still be finishing the three-way handshake
+		reply, _ := handshakeReply(c.localToken, msg.mType)
+		if reply != nil {
+			_ = udpWrite(conn, addr, reply)
+		}
+	case MessageTypeMigrate:
+		c.handleMigrate(conn, msg.payload, addr)
+	case MessageTypePing:
+		// punch packets of a migrating remote
+	case MessageTypeMigrateChallenge:
+		c.handleChallenge(msg.payload)
+	case MessageTypeMigrateAck:
+		c.mu.RLock()
+		ok := c.key != nil && c.challenge != nil &&
+			hmac.Equal(msg.payload, migrateMAC(c.key, "ack", c.challenge))
+		c.mu.RUnlock()
+		if ok {
+			select {
+			case c.acked <- struct{}{}:
+			default:
+			}
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// handleMigrate validates a migration the remote announces from addr. A
+// valid announcement is answered with a challenge to addr, the remote is
+// only moved there once it answered the challenge from there.
+func (c *migratingConn) handleMigrate(conn *net.UDPConn, payload []byte, addr *net.UDPAddr) {
+	if len(payload) < 1 || len(payload) != 1+int(payload[0])+sha256.Size {
+		return
+	}
+	announced, mac := payload[1:1+payload[0]], payload[1+payload[0]:]
+	c.mu.Lock()
+	if c.key == nil {
+		c.mu.Unlock()
+		log.Debugf("ignore migration to %s before the QUIC handshake\n", addr)
+		return
+	}
+	key := c.key
+	if challenge := c.challenges[addr.String()]; challenge != nil &&
+		hmac.Equal(mac, migrateMAC(key, "migrate", announced, challenge)) {
+		log.Debugf("remote migrated to %s\n", addr)
+		c.currentAddr = addr
+		clear(c.challenges)
+		c.mu.Unlock()
+		_ = udpWrite(conn, addr, NewMigrateAckMessage(c.localToken, migrateMAC(key, "ack", challenge)))
+		return
+	}
+	if !hmac.Equal(mac, migrateMAC(key, "migrate", announced)) {
+		c.mu.Unlock()
+		log.Debugf("ignore migration to %s with invalid mac\n", addr)
+		return
+	}
+	challenge := c.challenges[addr.String()]
+	if challenge == nil {
+		if len(c.challenges) >= maxMigrateChallenges {
+			clear(c.challenges)
+		}
+		challenge = make([]byte, migrateChallengeSize)
+		_, _ = rand.Read(challenge)
+		c.challenges[addr.String()] = challenge
+	}
+	c.mu.Unlock()
+
+	log.Debugf("remote announced migration from %s, mapped addr: %s\n", addr, announced)
+	if a, err := net.ResolveUDPAddr("udp4", string(announced)); err == nil && !udpAddrEqual(a, addr) {
+		// open our NAT towards the announced address, unless we are
+		// behind a full cone only packets from there get through to us
+		for i := 0; i < migratePunches; i++ {
+			_ = udpWrite(conn, a, NewPingMessage(c.localToken))
+		}
+	}
+	_ = udpWrite(conn, addr, NewMigrateChallengeMessage(c.localToken, challenge, migrateMAC(key, "challenge", challenge)))
+}
+
+// handleChallenge takes the remote's challenge to our announcement, the
+// next announcement answers it.
+func (c *migratingConn) handleChallenge(payload []byte) {
+	if len(payload) != migrateChallengeSize+sha256.Size {
+		return
+	}
+	challenge, mac := payload[:migrateChallengeSize], payload[migrateChallengeSize:]
+	c.mu.Lock()
+	if c.key == nil || !hmac.Equal(mac, migrateMAC(c.key, "challenge", challenge)) {
+		c.mu.Unlock()
+		return
+	}
+	if bytes.Equal(challenge, c.challenge) {
+		c.mu.Unlock()
+		return
+	}
+	c.challenge = append([]byte(nil), challenge...)
+	c.mu.Unlock()
+	select {
+	case c.challenged <- struct{}{}:
+	default:
+	}
+}
+
+// rebind replaces the underlying socket and closes the previous one.
+func (c *migratingConn) rebind(conn *net.UDPConn) error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		_ = conn.Close()
+		return net.ErrClosed
+	}
+	if c.readBuffer > 0 {
+		_ = conn.SetReadBuffer(c.readBuffer)
+	}
+	if c.writeBuffer > 0 {
+		_ = conn.SetWriteBuffer(c.writeBuffer)
+	}
+	old := c.conn
+	c.conn = conn
+	c.mu.Unlock()
+	return old.Close()
+}
+
+// announce tells the remote about our new socket until it acknowledges.
+// The remote punches towards addr, our mapped address, and then takes the
+// new address from the packet source once we answered its challenge.
+func (c *migratingConn) announce(ctx context.Context, addr string) error {
+	c.mu.Lock()
+	key := c.key
+	c.challenge = nil
+	c.mu.Unlock()
+	if key == nil {
+		return errMigrateNoKey
+	}
+	select {
+	case <-c.acked:
+	default:
+	}
+	tick := time.NewTicker(200 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		parts := [][]byte{[]byte(addr)}
+		c.mu.RLock()
+		if c.challenge != nil {
+			parts = append(parts, c.challenge)
+		}
+		c.mu.RUnlock()
+		msg, err := NewMigrateMessage(c.localToken, addr, migrateMAC(key, "migrate", parts...)).Marshal()
+		if err != nil {
+			return err
+		}
+		if _, err := c.WriteTo(msg, c.remoteAddr); err != nil {
+			log.Debugf("write migrate message error: %s\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("announce migration: %w", ctx.Err())
+		case <-c.acked:
+			return nil
+		case <-c.challenged:
+		case <-tick.C:
+		}
+	}
+}
+
+func (c *migratingConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.done)
+	}
+	return c.conn.Close()
+}
+
+func (c *migratingConn) LocalAddr() net.Addr { return c.udpConn().LocalAddr() }
+
+func (c *migratingConn) SetDeadline(t time.Time) error { return c.udpConn().SetDeadline(t) }
+
+func (c *migratingConn) SetReadDeadline(t time.Time) error { return c.udpConn().SetReadDeadline(t) }
+
+func (c *migratingConn) SetWriteDeadline(t time.Time) error { return c.udpConn().SetWriteDeadline(t) }
+
+// SetReadBuffer and SetWriteBuffer let quic-go size the socket buffers,
+// the sizes are reapplied to every socket installed by rebind.
+func (c *migratingConn) SetReadBuffer(bytes int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readBuffer = bytes
+	return c.conn.SetReadBuffer(bytes)
+}
+
+func (c *migratingConn) SetWriteBuffer(bytes int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeBuffer = bytes
+	return c.conn.SetWriteBuffer(bytes)
+}
+
+// watchNetwork migrates the tunnel to a new socket whenever the local route
+// to the remote changes, e.g. when moving from Wi-Fi to Ethernet.
+func (t *Tunnel) watchNetwork(conn *migratingConn) {
+	// the watch ends with the socket, e.g. when the Peer on it is closed
+	ctx, cancel := context.WithCancel(t.ctx)
+	defer cancel()
+	changes, err := watchAddrChanges(ctx)
+	if err != nil {
+		log.Debugf("watch network error: %s\n", err)
+		return
+	}
+	source := routeSource(conn.peerAddr())
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-conn.done:
+			return
+		case _, ok := <-changes:
+			if !ok {
+				return
+			}
+		}
+		debounce := time.NewTimer(migrateDebounce)
+	SETTLE:
+		for {
+			select {
+			case <-ctx.Done():
+				debounce.Stop()
+				return
+			case <-conn.done:
+				debounce.Stop()
+				return
+			case <-changes:
+			case <-debounce.C:
+				break SETTLE
+			}
+		}
+		newSource := routeSource(conn.peerAddr())
+		if newSource == nil || newSource.Equal(source) {
+			continue
+		}
+		log.Debugf("local route changed from %s to %s, migrating\n", source, newSource)
+		if err := t.migrate(conn); err != nil {
+			log.Debugf("migrate error: %s\n", err)
+			continue
+		}
+		source = newSource
+	}
+}
+
+// migrate binds a new socket, discovers its mapped address and announces it
+// to the remote. The socket that asked STUN is the one installed, so its
+// mapping is the one announced.
+func (t *Tunnel) migrate(conn *migratingConn) error {
+	udpConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		return err
+	}
+	mappedAddr, err := stunMappedAddr(udpConn)
+	if err != nil {
+		_ = udpConn.Close()
+		return err
+	}
+	if err = conn.rebind(udpConn); err != nil {
+		return err
+	}
+	localAddr := net.UDPAddr{
+		IP:   net.IPv4zero,
+		Port: udpConn.LocalAddr().(*net.UDPAddr).Port,
+	}
+	t.localAddr = localAddr
+	t.localNAT.Addr = mappedAddr
+	log.Debugf("rebind local addr: %s, mapped addr: %s\n", localAddr.String(), mappedAddr)
+	ctx, cancel := context.WithTimeout(t.ctx, migrateTimeout)
+	defer cancel()
+	return conn.announce(ctx, mappedAddr)
+}
+
+// routeSource returns the local IP the kernel currently uses to reach addr.
+func routeSource(addr *net.UDPAddr) net.IP {
+	// connecting a UDP socket only performs the route lookup, nothing is sent
+	conn, err := net.DialUDP("udp4", nil, addr)
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP
+}
+
+func udpAddrEqual(a, b *net.UDPAddr) bool {
+	return a.Port == b.Port && a.IP.Equal(b.IP)
+}
@@ -0,0 +1,336 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+const (
+	tokenA = "aaaaaaaa"
+	tokenB = "bbbbbbbb"
+)
+
+type packet struct {
+	data []byte
+	addr net.Addr
+}
+
+func listenLoopback(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+// readPackets delivers what QUIC would read from c, control messages
+// never show up.
+func readPackets(c *migratingConn) <-chan packet {
+	ch := make(chan packet, 16)
+	go func() {
+		defer close(ch)
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := c.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			ch <- packet{append([]byte(nil), buf[:n]...), addr}
+		}
+	}()
+	return ch
+}
+
+func expectPacket(t *testing.T, ch <-chan packet, data string, from net.Addr) {
+	t.Helper()
+	select {
+	case p := <-ch:
+		if string(p.data) != data || p.addr.String() != from.String() {
+			t.Fatalf("got %q from %s, want %q from %s", p.data, p.addr, data, from)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no packet %q", data)
+	}
+}
+
+// newMigratingPair connects two migratingConns over loopback, keyed alike
+// as after the QUIC handshake.
+func newMigratingPair(t *testing.T) (a, b *migratingConn) {
+	t.Helper()
+	ua, ub := listenLoopback(t), listenLoopback(t)
+	a = newMigratingConn(ua, *ub.LocalAddr().(*net.UDPAddr), tokenA, tokenB)
+	b = newMigratingConn(ub, *ua.LocalAddr().(*net.UDPAddr), tokenB, tokenA)
+	key := bytes.Repeat([]byte{1}, 32)
+	a.setKey(key)
+	b.setKey(key)
+	t.Cleanup(func() {
+		_ = a.Close()
+		_ = b.Close()
+	})
+	return a, b
+}
+
+func TestMigrate(t *testing.T) {
+	a, b := newMigratingPair(t)
+	recvA, recvB := readPackets(a), readPackets(b)
+	aAddr := a.LocalAddr()
+
+	if _, err := a.WriteTo([]byte("before"), a.remoteAddr); err != nil {
+		t.Fatal(err)
+	}
+	expectPacket(t, recvB, "before", aAddr)
+
+	moved := listenLoopback(t)
+	if err := a.rebind(moved); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := a.announce(ctx, moved.LocalAddr().String()); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.peerAddr(); !udpAddrEqual(got, moved.LocalAddr().(*net.UDPAddr)) {
+		t.Fatalf("remote at %s, want %s", got, moved.LocalAddr())
+	}
+
+	// QUIC on b still sees the address it connected to
+	if _, err := a.WriteTo([]byte("after"), a.remoteAddr); err != nil {
+		t.Fatal(err)
+	}
+	expectPacket(t, recvB, "after", aAddr)
+	if _, err := b.WriteTo([]byte("reply"), b.remoteAddr); err != nil {
+		t.Fatal(err)
+	}
+	expectPacket(t, recvA, "reply", b.LocalAddr())
+}
+
+func TestMigrateUnauthenticated(t *testing.T) {
+	a, b := newMigratingPair(t)
+	_ = readPackets(b)
+	want := b.peerAddr()
+	attacker := listenLoopback(t)
+	attackerAddr := attacker.LocalAddr().String()
+	bAddr := a.remoteAddr
+
+	// challenges the attacker gets answered on its socket
+	challenges := make(chan []byte, 4)
+	go func() {
+		for {
+			msg, _, err := udpRead(context.Background(), attacker)
+			if err != nil {
+				return
+			}
+			if msg.mType == MessageTypeMigrateChallenge {
+				challenges <- append([]byte(nil), msg.payload[:migrateChallengeSize]...)
+			}
+		}
+	}()
+
+	forged := migrateMAC(bytes.Repeat([]byte{2}, 32), "migrate", []byte(attackerAddr))
+	if err := udpWrite(attacker, bAddr, NewMigrateMessage(tokenA, attackerAddr, forged)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-challenges:
+		t.Fatal("forged migrate challenged")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// an announcement replayed from elsewhere only earns a challenge the
+	// attacker can't answer without the key
+	replayed := migrateMAC(a.key, "migrate", []byte(attackerAddr))
+	if err := udpWrite(attacker, bAddr, NewMigrateMessage(tokenA, attackerAddr, replayed)); err != nil {
+		t.Fatal(err)
+	}
+	var challenge []byte
+	select {
+	case challenge = <-challenges:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no challenge")
+	}
+	guessed := migrateMAC(bytes.Repeat([]byte{2}, 32), "migrate", []byte(attackerAddr), challenge)
+	if err := udpWrite(attacker, bAddr, NewMigrateMessage(tokenA, attackerAddr, guessed)); err != nil {
+		t.Fatal(err)
+	}
+	stale := migrateMAC(a.key, "migrate", []byte(attackerAddr), make([]byte, migrateChallengeSize))
+	if err := udpWrite(attacker, bAddr, NewMigrateMessage(tokenA, attackerAddr, stale)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if got := b.peerAddr(); !udpAddrEqual(got, want) {
+		t.Fatalf("remote moved to %s", got)
+	}
+}
+
+func TestMigrateWithoutKey(t *testing.T) {
+	ua, ub := listenLoopback(t), listenLoopback(t)
+	a := newMigratingConn(ua, *ub.LocalAddr().(*net.UDPAddr), tokenA, tokenB)
+	b := newMigratingConn(ub, *ua.LocalAddr().(*net.UDPAddr), tokenB, tokenA)
+	defer a.Close()
+	defer b.Close()
+	_ = readPackets(b)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := a.announce(ctx, ua.LocalAddr().String()); !errors.Is(err, errMigrateNoKey) {
+		t.Fatalf("announce: %v, want %v", err, errMigrateNoKey)
+	}
+
+	other := listenLoopback(t)
+	addr := other.LocalAddr().String()
+	mac := migrateMAC(bytes.Repeat([]byte{1}, 32), "migrate", []byte(addr))
+	if err := udpWrite(other, a.remoteAddr, NewMigrateMessage(tokenA, addr, mac)); err != nil {
+		t.Fatal(err)
+	}
+	_ = other.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, _, err := other.ReadFrom(make([]byte, 128)); err == nil {
+		t.Fatal("unkeyed conn answered a migration")
+	}
+}
+
+// TestMigratingConnLateHandshake checks that a remote still finishing the
+// three-way handshake gets its reply once QUIC owns the socket.
+func TestMigratingConnLateHandshake(t *testing.T) {
+	a, _ := newMigratingPair(t)
+	_ = readPackets(a)
+	remote := listenLoopback(t)
+	aAddr := a.LocalAddr().(*net.UDPAddr)
+
+	tests := []struct {
+		send MessageType
+		want MessageType
+	}{
+		{MessageTypeHandshake, MessageTypeHandshakeAck},
+		{MessageTypeHandshakeAck, MessageTypeConfirm},
+	}
+	for _, tt := range tests {
+		msg := &Message{header: magicHeader, version: 1, token: tokenB, mType: tt.send}
+		if err := udpWrite(remote, aAddr, msg); err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		reply, _, err := udpRead(ctx, remote)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply.mType != tt.want || reply.token != tokenA {
+			t.Fatalf("reply to %d: type %d token %s, want type %d token %s",
+				tt.send, reply.mType, reply.token, tt.want, tokenA)
+		}
+	}
+}
+
+// TestPunchConnKeep checks that the kept socket outlives the punching
+// context and its read deadline.
+func TestPunchConnKeep(t *testing.T) {
+	conn, remote := listenLoopback(t), listenLoopback(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	pc := newPunchConn(ctx, &Tunnel{}, conn)
+	if err := udpWrite(remote, conn.LocalAddr().(*net.UDPAddr), NewHandshakeMessage(tokenB)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := pc.read(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !pc.keep() {
+		t.Fatal("socket closed before keep")
+	}
+	<-ctx.Done()
+	time.Sleep(50 * time.Millisecond)
+
+	if _, err := remote.WriteTo([]byte("quic"), conn.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "quic" {
+		t.Fatalf("read %q", buf[:n])
+	}
+}
+
+// TestQuicConnectMigrate runs QUIC over two punched sockets as quicConnect
+// sets them up, and moves one side to a new socket mid-connection.
+func TestQuicConnectMigrate(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ua, ub := listenLoopback(t), listenLoopback(t)
+	a := newMigratingConn(ua, *ub.LocalAddr().(*net.UDPAddr), tokenA, tokenB)
+	b := newMigratingConn(ub, *ua.LocalAddr().(*net.UDPAddr), tokenB, tokenA)
+	tunnel := func(conn *migratingConn, local, remote string) *Tunnel {
+		return &Tunnel{
+			ctx:        ctx,
+			conn:       conn,
+			remoteAddr: *conn.remoteAddr,
+			localNAT:   &NATDetail{Token: local},
+			remoteNAT:  &NATDetail{Token: remote},
+		}
+	}
+	type result struct {
+		t   *quicTransport
+		err error
+	}
+	accepted := make(chan result, 1)
+	go func() {
+		qt, err := upgrade(tunnel(a, tokenA, tokenB)).quicConnect(ctx)
+		accepted <- result{qt, err}
+	}()
+	dialer, err := upgrade(tunnel(b, tokenB, tokenA)).quicConnect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dialer.Close()
+	r := <-accepted
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	defer r.t.Close()
+	if a.key == nil || !bytes.Equal(a.key, b.key) {
+		t.Fatalf("migration keys differ: %x, %x", a.key, b.key)
+	}
+
+	moved := listenLoopback(t)
+	if err := a.rebind(moved); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.announce(ctx, moved.LocalAddr().String()); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		s, err := r.t.AcceptStream(ctx)
+		if err != nil {
+			return
+		}
+		defer s.Close()
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(s, buf); err == nil {
+			_, _ = s.Write(buf)
+		}
+	}()
+	s, err := dialer.OpenStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err = s.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err = io.ReadFull(s, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("echo %q", buf)
+	}
+}
@@ -0,0 +1,61 @@
+//go:build linux
+
+package tunnel
+
+import (
+	"context"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// watchAddrChanges reports local IPv4 address and route changes using rtnetlink.
+// The returned channel is closed when ctx is done or the netlink socket fails.
+func watchAddrChanges(ctx context.Context) (<-chan struct{}, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+	sa := &unix.SockaddrNetlink{
+		Family: unix.AF_NETLINK,
+		Groups: unix.RTMGRP_IPV4_IFADDR | unix.RTMGRP_IPV4_ROUTE,
+	}
+	if err = unix.Bind(fd, sa); err != nil {
+		_ = unix.Close(fd)
+		return nil, err
+	}
+	// a non-blocking fd makes the file pollable, so Close unblocks Read
+	f := os.NewFile(uintptr(fd), "netlink")
+	go func() {
+		<-ctx.Done()
+		_ = f.Close()
+	}()
+
+	c := make(chan struct{}, 1)
+	go func() {
+		defer close(c)
+		bytes := make([]byte, 8192)
+		for {
+			n, err := f.Read(bytes)
+			if err != nil {
+				log.Debugf("netlink read error: %s\n", err)
+				return
+			}
+			msgs, err := syscall.ParseNetlinkMessage(bytes[:n])
+			if err != nil {
+				continue
+			}
+			for _, m := range msgs {
+				switch m.Header.Type {
+				case unix.RTM_NEWADDR, unix.RTM_DELADDR, unix.RTM_NEWROUTE, unix.RTM_DELROUTE:
+					select {
+					case c <- struct{}{}:
+					default:
+					}
+				}
+			}
+		}
+	}()
+	return c, nil
+}
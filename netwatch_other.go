@@ -0,0 +1,60 @@
+//go:build !linux
+
+package tunnel
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// netwatchInterval is how often local addresses are polled where no
+// change notification API is wired up.
+const netwatchInterval = time.Second * 2
+
+// watchAddrChanges reports local address changes by polling the interface addresses.
+// The returned channel is closed when ctx is done.
+func watchAddrChanges(ctx context.Context) (<-chan struct{}, error) {
+	last, err := addrSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	c := make(chan struct{}, 1)
+	go func() {
+		defer close(c)
+		tick := time.NewTicker(netwatchInterval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick.C:
+				current, err := addrSnapshot()
+				if err != nil || current == last {
+					continue
+				}
+				last = current
+				select {
+				case c <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return c, nil
+}
+
+func addrSnapshot() (string, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "", err
+	}
+	s := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		s = append(s, a.String())
+	}
+	sort.Strings(s)
+	return strings.Join(s, ","), nil
+}
@@ -0,0 +1,261 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Pipe returns two Peers connected in memory over HTTP/2, like net.Pipe
+// for net.Conn. It is meant for tests of code built on Peer: streams,
+// datagrams and requests behave as over a tunnel, without any network.
+func Pipe() (*Peer, *Peer) {
+	ta, tb := newMemTransportPair()
+	return newHTTP2Peer(context.Background(), ta), newHTTP2Peer(context.Background(), tb)
+}
+
+// memTransport is an in-memory transport, newMemTransportPair returns both
+// ends. Streams are buffered in-memory pipes, closing either end breaks them
+// like closing a QUIC connection does.
+type memTransport struct {
+	remote    *memTransport
+	streams   chan net.Conn
+	datagrams chan []byte
+	live      *memStreams
+	done      chan struct{}
+	once      sync.Once
+}
+
+// memStreams are the open streams of a memTransport pair.
+type memStreams struct {
+	mu     sync.Mutex
+	conns  []net.Conn
+	closed bool
+}
+
+// add tracks conns, it fails once the transport is closed.
+func (s *memStreams) add(conns ...net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns = append(s.conns, conns...)
+	return true
+}
+
+func (s *memStreams) close() {
+	s.mu.Lock()
+	conns := s.conns
+	s.conns, s.closed = nil, true
+	s.mu.Unlock()
+	for _, c := range conns {
+		_ = c.Close()
+	}
+}
+
+// memAddr is the address of either end of a memTransport.
+type memAddr string
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string  { return string(a) }
+
+func newMemTransportPair() (transport, transport) {
+	live := &memStreams{}
+	a := &memTransport{
+		streams:   make(chan net.Conn),
+		datagrams: make(chan []byte, 64),
+		live:      live,
+		done:      make(chan struct{}),
+	}
+	b := &memTransport{
+		remote:    a,
+		streams:   make(chan net.Conn),
+		datagrams: make(chan []byte, 64),
+		live:      live,
+		done:      make(chan struct{}),
+	}
+	a.remote = b
+	return a, b
+}
+
+func (t *memTransport) OpenStream(ctx context.Context) (net.Conn, error) {
+	local, remote := newMemConnPair()
+	if !t.live.add(local, remote) {
+		return nil, net.ErrClosed
+	}
+	select {
+	case t.remote.streams <- remote:
+		return local, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-t.done:
+		return nil, net.ErrClosed
+	case <-t.remote.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (t *memTransport) AcceptStream(ctx context.Context) (net.Conn, error) {
+	select {
+	case conn := <-t.streams:
+		return conn, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-t.done:
+		return nil, net.ErrClosed
+	case <-t.remote.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (t *memTransport) SendDatagram(b []byte) error {
+	if len(b) > quicMaxDatagramSize {
+		return errDatagramTooLarge(len(b), quicMaxDatagramSize)
+	}
+	select {
+	case <-t.done:
+		return net.ErrClosed
+	case t.remote.datagrams <- append([]byte(nil), b...):
+	default:
+		// queue full, lose the datagram like a network would
+	}
+	return nil
+}
+
+func (t *memTransport) ReceiveDatagram(ctx context.Context) ([]byte, error) {
+	select {
+	case b := <-t.datagrams:
+		return b, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-t.done:
+		return nil, net.ErrClosed
+	case <-t.remote.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (t *memTransport) MaxDatagramSize() int { return quicMaxDatagramSize }
+
+func (t *memTransport) Close() error {
+	t.once.Do(func() {
+		close(t.done)
+		t.live.close()
+	})
+	return nil
+}
+
+func (t *memTransport) LocalAddr() net.Addr  { return memAddr("local") }
+func (t *memTransport) RemoteAddr() net.Addr { return memAddr("remote") }
+
+// memPipe is one direction of a memConn. Unlike net.Pipe, writes are buffered
+// and never wait for the reader, like writes on a QUIC stream.
+type memPipe struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	buf      bytes.Buffer
+	closed   bool // writer closed, reads drain then EOF
+	aborted  bool // reader closed
+	deadline time.Time
+	timer    *time.Timer
+}
+
+func newMemPipe() *memPipe {
+	p := &memPipe{}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// memConn is a net.Conn backed by two memPipes.
+type memConn struct {
+	r *memPipe
+	w *memPipe
+}
+
+func newMemConnPair() (net.Conn, net.Conn) {
+	a, b := newMemPipe(), newMemPipe()
+	return &memConn{r: a, w: b}, &memConn{r: b, w: a}
+}
+
+func (c *memConn) Read(b []byte) (int, error) {
+	p := c.r
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.buf.Len() == 0 {
+		switch {
+		case p.aborted:
+			return 0, net.ErrClosed
+		case p.closed:
+			return 0, io.EOF
+		case !p.deadline.IsZero() && !time.Now().Before(p.deadline):
+			return 0, os.ErrDeadlineExceeded
+		}
+		p.cond.Wait()
+	}
+	return p.buf.Read(b)
+}
+
+func (c *memConn) Write(b []byte) (int, error) {
+	p := c.w
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed || p.aborted {
+		return 0, io.ErrClosedPipe
+	}
+	p.buf.Write(b)
+	p.cond.Broadcast()
+	return len(b), nil
+}
+
+// CloseWrite closes the write direction only, the remote reads EOF.
+func (c *memConn) CloseWrite() error {
+	c.w.mu.Lock()
+	c.w.closed = true
+	c.w.cond.Broadcast()
+	c.w.mu.Unlock()
+	return nil
+}
+
+func (c *memConn) Close() error {
+	_ = c.CloseWrite()
+	c.r.mu.Lock()
+	c.r.aborted = true
+	c.r.cond.Broadcast()
+	c.r.mu.Unlock()
+	return nil
+}
+
+func (c *memConn) LocalAddr() net.Addr  { return memAddr("local") }
+func (c *memConn) RemoteAddr() net.Addr { return memAddr("remote") }
+
+func (c *memConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetWriteDeadline is a no-op, writes never block.
+func (c *memConn) SetWriteDeadline(time.Time) error { return nil }
+
+func (c *memConn) SetReadDeadline(t time.Time) error {
+	p := c.r
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.deadline = t
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	if !t.IsZero() {
+		// wake up pending reads once the deadline passed
+		p.timer = time.AfterFunc(time.Until(t), func() {
+			p.mu.Lock()
+			p.cond.Broadcast()
+			p.mu.Unlock()
+		})
+	}
+	p.cond.Broadcast()
+	return nil
+}
@@ -0,0 +1,133 @@
+package tunnel
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+)
+
+// proxyPath is where a Peer serves the plain HTTP requests of the remote's
+// HTTP proxy, the request's absolute URL travels in proxyURLHeader.
+const (
+	proxyPath      = "/" + reservedPrefix + "proxy"
+	proxyURLHeader = "Tunnel-Proxy-Url"
+)
+
+// proxyTransport sends the requests the remote's HTTP proxy forwards to us.
+// It does not use a proxy itself.
+var proxyTransport = &http.Transport{
+	DialContext:           (&net.Dialer{Timeout: forwardTimeout}).DialContext,
+	ForceAttemptHTTP2:     true,
+	MaxIdleConns:          100,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ExpectContinueTimeout: 1 * time.Second,
+}
+
+// ListenHTTPProxy runs an HTTP proxy on addr using the remote as exit, for
+// tools configured with HTTP_PROXY/HTTPS_PROXY. Plain HTTP requests are sent
+// through Client and made by the remote, CONNECT (HTTPS) is tunneled over a
+// stream the remote dials. Destinations are subject to the remote's
+// AllowForward list. Closing the returned listener stops the proxy.
+func (p *Peer) ListenHTTPProxy(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	forward := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.Out.Header.Set(proxyURLHeader, r.In.URL.String())
+			r.Out.URL = &url.URL{Scheme: "https", Host: "tunnel", Path: proxyPath}
+			r.Out.Host = ""
+		},
+		Transport: p.Client.Transport,
+	}
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodConnect {
+				p.proxyConnect(w, r)
+				return
+			}
+			if !r.URL.IsAbs() {
+				http.Error(w, "not a proxy request", http.StatusBadRequest)
+				return
+			}
+			forward.ServeHTTP(w, r)
+		}),
+	}
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Debugf("http proxy error: %s\n", err)
+		}
+	}()
+	return ln, nil
+}
+
+// proxyConnect tunnels a CONNECT request over a stream to the target.
+func (p *Peer) proxyConnect(w http.ResponseWriter, r *http.Request) {
+	s, err := p.dialRemote(r.Host)
+	if err != nil {
+		log.Debugf("http proxy connect %s error: %s\n", r.Host, err)
+		if errors.Is(err, errForwardDenied) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+		} else {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		}
+		return
+	}
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		_ = s.Close()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		_ = conn.Close()
+		_ = s.Close()
+		return
+	}
+	// the client may have sent the start of the tunneled data already
+	if n := rw.Reader.Buffered(); n > 0 {
+		b, _ := rw.Reader.Peek(n)
+		if _, err = s.Write(b); err != nil {
+			_ = conn.Close()
+			_ = s.Close()
+			return
+		}
+	}
+	pipe(conn, s.Conn)
+}
+
+// serveProxy makes a plain HTTP request for the remote's HTTP proxy, if the
+// destination is allowed.
+func (p *Peer) serveProxy(w http.ResponseWriter, r *http.Request) {
+	target, err := url.Parse(r.Header.Get(proxyURLHeader))
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		http.Error(w, "invalid proxy url", http.StatusBadRequest)
+		return
+	}
+	port := target.Port()
+	if port == "" {
+		port = "80"
+		if target.Scheme == "https" {
+			port = "443"
+		}
+	}
+	if !p.forwardAllowed(net.JoinHostPort(target.Hostname(), port)) {
+		log.Debugf("http proxy to %s denied\n", target.Host)
+		http.Error(w, errForwardDenied.Error(), http.StatusForbidden)
+		return
+	}
+	rp := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.Out.Header.Del(proxyURLHeader)
+			r.Out.URL = target
+			r.Out.Host = ""
+		},
+		Transport: proxyTransport,
+	}
+	rp.ServeHTTP(w, r)
+}
@@ -0,0 +1,151 @@
+package tunnel
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPProxy(t *testing.T) {
+	// answers with what arrived, to see the request made it unchanged
+	inspect := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s %s %q %q", r.Method, r.URL.RequestURI(), body,
+			r.Header.Get("X-Test"), r.Header.Get(proxyURLHeader))
+	})
+	plain := httptest.NewServer(inspect)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(inspect)
+	defer secure.Close()
+
+	for _, pp := range peerPairs {
+		t.Run(pp.name, func(t *testing.T) {
+			a, b := pp.pair(t)
+			b.AllowForward(plain.Listener.Addr().String(), secure.Listener.Addr().String())
+			ln, err := a.ListenHTTPProxy("127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			client := &http.Client{
+				Transport: &http.Transport{
+					Proxy:           http.ProxyURL(&url.URL{Scheme: "http", Host: ln.Addr().String()}),
+					TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+				},
+				Timeout: 10 * time.Second,
+			}
+			defer client.CloseIdleConnections()
+
+			// plain requests go through Client, https ones through CONNECT
+			for _, base := range []string{plain.URL, secure.URL} {
+				req, err := http.NewRequest(http.MethodPost, base+"/path?q=1", strings.NewReader("payload"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				req.Header.Set("X-Test", "kept")
+				resp, err := client.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body, _ := io.ReadAll(resp.Body)
+				_ = resp.Body.Close()
+				if want := `POST /path?q=1 payload "kept" ""`; resp.StatusCode != http.StatusOK || string(body) != want {
+					t.Fatalf("%s: %d %q, want %q", base, resp.StatusCode, body, want)
+				}
+			}
+		})
+	}
+}
+
+func TestHTTPProxyRefused(t *testing.T) {
+	a, _ := newPeerPair(t)
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	ln, err := a.ListenHTTPProxy("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	tests := []struct {
+		name    string
+		request string
+		want    int
+	}{
+		{"plain denied", "GET " + srv.URL + "/ HTTP/1.1\r\nHost: " + srv.Listener.Addr().String(), http.StatusForbidden},
+		{"connect denied", "CONNECT " + srv.Listener.Addr().String() + " HTTP/1.1\r\nHost: " + srv.Listener.Addr().String(), http.StatusForbidden},
+		{"not a proxy request", "GET / HTTP/1.1\r\nHost: " + ln.Addr().String(), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+			if _, err = io.WriteString(conn, tt.request+"\r\n\r\n"); err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+// TestHTTPProxyConnectEarlyData sends data right behind the CONNECT request,
+// before the proxy answered, it must not get lost.
+func TestHTTPProxyConnectEarlyData(t *testing.T) {
+	a, b := newPeerPair(t)
+	echo := listenEcho(t)
+	b.AllowForward(echo)
+	ln, err := a.ListenHTTPProxy("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	req := "CONNECT " + echo + " HTTP/1.1\r\nHost: " + echo + "\r\n\r\nearly"
+	if _, err = io.WriteString(conn, req); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	if _, err = io.WriteString(conn, " and late"); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.(*net.TCPConn).CloseWrite()
+	got, err := io.ReadAll(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "early and late" {
+		t.Fatalf("echoed %q", got)
+	}
+}
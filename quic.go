@@ -7,17 +7,44 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
-	"io"
 	"math/big"
-	"time"
+	"net"
 
 	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+	"github.com/quic-go/quic-go/quicvarint"
 )
 
+// quicMaxDatagramFrame is the largest DATAGRAM frame we send. It is the
+// size quic-go advertises and accepts itself (protocol.MaxDatagramFrameSize,
+// internal to quic-go), small enough for any packet. The remote may allow
+// less with its max_datagram_frame_size transport parameter.
+const quicMaxDatagramFrame = 1200
+
+// quicMaxDatagramSize is the payload of a quicMaxDatagramFrame, used until
+// the remote's transport parameters are known: 1 byte frame type and a
+// 2 byte varint length precede it.
+const quicMaxDatagramSize = quicMaxDatagramFrame - 3
+
+// datagramPayload returns the largest payload of a DATAGRAM frame of at
+// most frameSize bytes, the way quic-go's SendMessage checks it.
+func datagramPayload(frameSize int64) int {
+	n := frameSize - 1
+	// the length field shrinks with the payload
+	for n > 0 && 1+int64(quicvarint.Len(uint64(n)))+n > frameSize {
+		n--
+	}
+	return int(max(n, 0))
+}
+
+// quicConfig enables RFC 9221 datagrams next to the streams.
+func quicConfig() *quic.Config {
+	return &quic.Config{EnableDatagrams: true}
+}
+
 type QuicWrapper struct {
 	tr     *quic.Transport
 	tunnel *Tunnel
-	ctx    context.Context
 }
 
 func upgrade(tunnel *Tunnel) *QuicWrapper {
@@ -28,104 +55,156 @@ func upgrade(tunnel *Tunnel) *QuicWrapper {
 	return &QuicWrapper{
 		tr:     &tr,
 		tunnel: tunnel,
-		ctx:    tunnel.ctx,
 	}
 }
 
-func (q *QuicWrapper) listen() {
-	tr := q.tr
+// quicConnect returns a QUIC transport to the remote peer.
+// Token comparison deterministically assigns roles: greater token dials, lesser listens.
+// This ensures exactly one connection is established with unambiguous direction.
+func (q *QuicWrapper) quicConnect(ctx context.Context) (*quicTransport, error) {
+	localToken := q.tunnel.localNAT.Token
+	remoteToken := q.tunnel.remoteNAT.Token
+	stats := &quicStats{}
+	cfg := quicConfig()
+	cfg.Tracer = func(context.Context, logging.Perspective, quic.ConnectionID) logging.ConnectionTracer {
+		return stats
+	}
+
+	if localToken > remoteToken {
+		session, err := q.tr.Dial(ctx, q.tunnel.peerAddr(), &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         []string{"h2", "tunnel"},
+		}, cfg)
+		if err != nil {
+			return nil, err
+		}
+		q.enableMigration(session)
+		t := newQuicTransport(session)
+		t.qtr, t.pconn = q.tr, q.tunnel.conn
+		t.stats = stats
+		return t, nil
+	}
+
 	tlsCfg, err := generateTLSConfig()
 	if err != nil {
-		log.Debugf("generate tls config error: %v\n", err)
-		return
+		return nil, err
 	}
-	listener, err := tr.Listen(tlsCfg, nil)
+	listener, err := q.tr.Listen(tlsCfg, cfg)
 	if err != nil {
-		log.Debugf("listen error: %v\n", err)
-		return
+		return nil, err
 	}
-	defer listener.Close()
-	ctx := q.ctx
-	for {
-		log.Debugf("quic server accept\n")
-		session, err := listener.Accept(ctx)
-		if err != nil {
-			log.Debugf("listener error: %v", err)
-			break
-		}
-		go serverSessionHandler(ctx, session)
+	session, err := listener.Accept(ctx)
+	if err != nil {
+		listener.Close()
+		return nil, err
 	}
+	// Do not close listener — closing it terminates all accepted sessions.
+	// The transport closes it with the session.
+	q.enableMigration(session)
+	t := newQuicTransport(session)
+	t.ln = listener
+	t.qtr, t.pconn = q.tr, q.tunnel.conn
+	t.stats = stats
+	return t, nil
 }
 
-func (q *QuicWrapper) dial() {
-	tlsConf := &tls.Config{
-		InsecureSkipVerify: true,
-		NextProtos:         []string{"tunnel"},
-	}
-	tr := quic.Transport{
-		Conn: q.tunnel.conn,
+// enableMigration keys the migration messages of a punched socket with the
+// TLS session of conn, relayed connections have nothing to migrate.
+func (q *QuicWrapper) enableMigration(conn quic.Connection) {
+	mc, ok := q.tunnel.conn.(*migratingConn)
+	if !ok {
+		return
 	}
-	ctx := q.ctx
-	connection, err := tr.Dial(ctx, &q.tunnel.remoteAddr, tlsConf, nil)
+	key, err := migrationKey(conn)
 	if err != nil {
-		log.Debugf("dial error: %v\n", err)
+		log.Debugf("export migration key error: %s\n", err)
 		return
 	}
-	stream, err := connection.OpenStreamSync(ctx)
+	mc.setKey(key)
+}
+
+// quicTransport runs streams and datagrams over a QUIC connection, on a
+// punched UDP socket or through a relay alike.
+type quicTransport struct {
+	conn quic.Connection
+	// ln accepted conn, nil if we dialed
+	ln *quic.Listener
+	// qtr runs conn on pconn, the punched or relayed socket; both belong to
+	// the transport if set up by quicConnect
+	qtr   *quic.Transport
+	pconn net.PacketConn
+	// stats is traced from conn, nil if not set up by quicConnect
+	stats *quicStats
+}
+
+func newQuicTransport(conn quic.Connection) *quicTransport {
+	return &quicTransport{conn: conn}
+}
+
+func (t *quicTransport) OpenStream(ctx context.Context) (net.Conn, error) {
+	s, err := t.conn.OpenStreamSync(ctx)
 	if err != nil {
-		log.Debugf("open stream error: %v\n", err)
-		return
+		return nil, err
 	}
-	tick := time.NewTicker(time.Second)
+	return newQuicStreamConn(s, t.conn), nil
+}
 
-	for range tick.C {
-		_, err = stream.Write([]byte("foobar"))
-		if err != nil {
-			log.Debugf("write error: %s\n", err.Error())
-			break
-		}
-		log.Debugln("client write")
+func (t *quicTransport) AcceptStream(ctx context.Context) (net.Conn, error) {
+	s, err := t.conn.AcceptStream(ctx)
+	if err != nil {
+		return nil, err
 	}
-	log.Debugln("client exit")
+	return newQuicStreamConn(s, t.conn), nil
 }
 
-func serverSessionHandler(ctx context.Context, session quic.Connection) {
-	log.Debugln("handling session...")
-	defer func() {
-		if err := session.CloseWithError(0, "Close"); err != nil {
-			log.Debugf("session Close error: %v\n", err)
-		}
-	}()
-	for {
-		stream, err := session.AcceptStream(ctx)
-		if err != nil {
-			log.Debugf("session error: %v\n", err)
-			break
-		}
-		go serverStreamHandler(stream)
+func (t *quicTransport) SendDatagram(b []byte) error {
+	limit := t.MaxDatagramSize()
+	if limit == 0 {
+		return ErrDatagramsUnsupported
+	}
+	if len(b) > limit {
+		return errDatagramTooLarge(len(b), limit)
 	}
+	return t.conn.SendMessage(b)
 }
 
-func serverStreamHandler(stream io.ReadWriteCloser) {
-	log.Debugf("handling stream...")
-	defer stream.Close()
-	bytes := make([]byte, 1024)
-OUTER:
-	for {
-		n, err := stream.Read(bytes)
-		if err != nil {
-			log.Debugf("read error: %s\n", err.Error())
-			break OUTER
-		}
-		log.Debugf("server read: %s\n", string(bytes[:n]))
-		_, err = stream.Write(bytes[:n])
-		if err != nil {
-			log.Debugf("write error: %s\n", err.Error())
-			break OUTER
-		}
+func (t *quicTransport) ReceiveDatagram(ctx context.Context) ([]byte, error) {
+	return t.conn.ReceiveMessage(ctx)
+}
+
+// MaxDatagramSize is zero unless both sides enabled datagrams in the
+// handshake, otherwise derived from the frame size the remote accepts.
+func (t *quicTransport) MaxDatagramSize() int {
+	if !t.conn.ConnectionState().SupportsDatagrams {
+		return 0
+	}
+	if t.stats == nil {
+		return quicMaxDatagramSize
+	}
+	frame := t.stats.maxDatagramFrame.Load()
+	if frame <= 0 {
+		return quicMaxDatagramSize
 	}
+	return datagramPayload(min(frame, quicMaxDatagramFrame))
 }
 
+func (t *quicTransport) Close() error {
+	err := t.conn.CloseWithError(0, "")
+	if t.ln != nil {
+		_ = t.ln.Close()
+	}
+	if t.qtr != nil {
+		_ = t.qtr.Close()
+	}
+	if t.pconn != nil {
+		_ = t.pconn.Close()
+	}
+	return err
+}
+
+func (t *quicTransport) LocalAddr() net.Addr  { return t.conn.LocalAddr() }
+func (t *quicTransport) RemoteAddr() net.Addr { return t.conn.RemoteAddr() }
+
 func generateTLSConfig() (*tls.Config, error) {
 	key, err := rsa.GenerateKey(rand.Reader, 1024)
 	if err != nil {
@@ -0,0 +1,113 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+)
+
+func TestDatagramPayload(t *testing.T) {
+	tests := []struct {
+		frame int64
+		want  int
+	}{
+		{1200, 1197},
+		{65, 63},
+		{66, 63},
+		{67, 64},
+		{2, 0},
+		{0, 0},
+	}
+	for _, tt := range tests {
+		if got := datagramPayload(tt.frame); got != tt.want {
+			t.Errorf("datagramPayload(%d) = %d, want %d", tt.frame, got, tt.want)
+		}
+	}
+}
+
+// newQuicPair connects two quicTransports over loopback the way quicConnect
+// does, with datagrams and the stats tracer.
+func newQuicPair(t *testing.T) (*quicTransport, *quicTransport) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	config := func(stats *quicStats) *quic.Config {
+		cfg := quicConfig()
+		cfg.Tracer = func(context.Context, logging.Perspective, quic.ConnectionID) logging.ConnectionTracer {
+			return stats
+		}
+		return cfg
+	}
+	tlsCfg, err := generateTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverStats := &quicStats{}
+	ln, err := quic.ListenAddr("127.0.0.1:0", tlsCfg, config(serverStats))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientStats := &quicStats{}
+	conn, err := quic.DialAddr(ctx, ln.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"h2", "tunnel"},
+	}, config(clientStats))
+	if err != nil {
+		_ = ln.Close()
+		t.Fatal(err)
+	}
+	accepted, err := ln.Accept(ctx)
+	if err != nil {
+		_ = ln.Close()
+		t.Fatal(err)
+	}
+	client := newQuicTransport(conn)
+	client.stats = clientStats
+	server := newQuicTransport(accepted)
+	server.ln = ln
+	server.stats = serverStats
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	return client, server
+}
+
+// TestQuicMaxDatagramSize checks the limit against the quic-go in use: the
+// largest datagram is sent, one byte more is refused by quic-go itself.
+func TestQuicMaxDatagramSize(t *testing.T) {
+	client, server := newQuicPair(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, tr := range []*quicTransport{client, server} {
+		limit := tr.MaxDatagramSize()
+		if limit != datagramPayload(quicMaxDatagramFrame) {
+			t.Fatalf("max datagram size %d, want %d", limit, datagramPayload(quicMaxDatagramFrame))
+		}
+		if err := tr.conn.SendMessage(make([]byte, limit+1)); err == nil {
+			t.Fatalf("quic-go sent a datagram of %d bytes, over the limit", limit+1)
+		}
+	}
+
+	want := make([]byte, client.MaxDatagramSize())
+	copy(want, "hello")
+	go func() {
+		// unreliable, so send until one arrives
+		for ctx.Err() == nil {
+			_ = client.SendDatagram(want)
+			time.Sleep(50 * time.Millisecond)
+		}
+	}()
+	got, err := server.ReceiveDatagram(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(want) {
+		t.Fatalf("got datagram of %d bytes, want %d", len(got), len(want))
+	}
+}
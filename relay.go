@@ -0,0 +1,37 @@
+package tunnel
+
+import (
+	"net"
+
+	"tunnel/relay"
+)
+
+// WithRelay falls back to the relay server at url (ws:// or wss://) when
+// neither UDP nor TCP hole punching works. Both peers have to use the same
+// relay; QUIC and everything above run over it unchanged.
+func WithRelay(url string) Option {
+	return func(t *Tunnel) {
+		t.relayURL = url
+	}
+}
+
+// connectRelay registers at the relay under the local token and addresses
+// the remote by its token.
+func (t *Tunnel) connectRelay() error {
+	log.Debugln("connect relay ...")
+	conn, err := relay.Dial(t.ctx, t.relayURL, t.localNAT.Token)
+	if err != nil {
+		return err
+	}
+	t.conn = conn
+	t.relayAddr = relay.Addr{Key: t.remoteNAT.Token}
+	return nil
+}
+
+// peerAddr returns the address QUIC reaches the remote at.
+func (t *Tunnel) peerAddr() net.Addr {
+	if t.relayAddr != nil {
+		return t.relayAddr
+	}
+	return &t.remoteAddr
+}
@@ -0,0 +1,186 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type packet struct {
+	src     string
+	payload []byte
+}
+
+// Conn is a net.PacketConn whose packets travel through a relay Server.
+// Addresses are relay Addr values holding the peer's key.
+type Conn struct {
+	ws        *websocket.Conn
+	key       string
+	in        chan packet
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
+
+	writeMu sync.Mutex
+
+	deadlineMu   sync.Mutex
+	readDeadline time.Time
+	deadlineSet  chan struct{}
+}
+
+// Dial connects to the relay at rawURL (ws:// or wss://) and registers key.
+func Dial(ctx context.Context, rawURL string, key string) (*Conn, error) {
+	if err := validKey(key); err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set(KeyParam, key)
+	u.RawQuery = q.Encode()
+	ws, resp, err := websocket.DefaultDialer.DialContext(ctx, u.String(), nil)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusConflict {
+			err = ErrKeyTaken
+		}
+		return nil, fmt.Errorf("dial relay: %w", err)
+	}
+	c := &Conn{
+		ws:          ws,
+		key:         key,
+		in:          make(chan packet, queueSize),
+		done:        make(chan struct{}),
+		deadlineSet: make(chan struct{}),
+	}
+	go c.readLoop()
+	return c, nil
+}
+
+func (c *Conn) readLoop() {
+	for {
+		messageType, frame, err := c.ws.ReadMessage()
+		if err != nil {
+			c.closeWithError(err)
+			return
+		}
+		if messageType != websocket.BinaryMessage {
+			continue
+		}
+		src, payload, err := decodePacket(frame)
+		if err != nil {
+			continue
+		}
+		select {
+		case c.in <- packet{src: src, payload: payload}:
+		case <-c.done:
+			return
+		default:
+			// reader too slow, drop the packet
+		}
+	}
+}
+
+func (c *Conn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		c.deadlineMu.Lock()
+		deadline := c.readDeadline
+		deadlineSet := c.deadlineSet
+		c.deadlineMu.Unlock()
+
+		var timer *time.Timer
+		var expired <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(d)
+			expired = timer.C
+		}
+		select {
+		case pkt := <-c.in:
+			stopTimer(timer)
+			return copy(p, pkt.payload), Addr{Key: pkt.src}, nil
+		case <-c.done:
+			stopTimer(timer)
+			return 0, nil, c.err
+		case <-expired:
+			return 0, nil, os.ErrDeadlineExceeded
+		case <-deadlineSet:
+			// deadline changed, start over
+			stopTimer(timer)
+		}
+	}
+}
+
+func (c *Conn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	a, ok := addr.(Addr)
+	if !ok {
+		return 0, fmt.Errorf("relay: unsupported address %s", addr)
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, encodePacket(a.Key, p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *Conn) Close() error {
+	c.closeWithError(net.ErrClosed)
+	return nil
+}
+
+func (c *Conn) closeWithError(err error) {
+	c.closeOnce.Do(func() {
+		c.err = err
+		close(c.done)
+		_ = c.ws.Close()
+	})
+}
+
+func (c *Conn) LocalAddr() net.Addr { return Addr{Key: c.key} }
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	c.readDeadline = t
+	// wake up pending reads so they pick up the new deadline
+	close(c.deadlineSet)
+	c.deadlineSet = make(chan struct{})
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.ws.SetWriteDeadline(t)
+}
+
+func stopTimer(t *time.Timer) {
+	if t != nil {
+		t.Stop()
+	}
+}
+
+// SetReadBuffer and SetWriteBuffer exist for quic-go, which sizes the buffers
+// of the conns it runs on. Packets are buffered in the WebSocket connection,
+// so there is nothing to size.
+func (c *Conn) SetReadBuffer(bytes int) error  { return nil }
+func (c *Conn) SetWriteBuffer(bytes int) error { return nil }
@@ -0,0 +1,58 @@
+// Package relay forwards packets between peers that cannot reach each other
+// directly, e.g. on networks that drop both UDP and TCP hole punching.
+//
+// Peers connect outbound to the relay over WebSocket (usually wss on 443) and
+// register under a key. Every binary WebSocket message carries one packet:
+//
+//	1 byte key length
+//	n bytes key, the destination when sent to the relay, the source when received
+//	0-n bytes payload
+//
+// The relay does not authenticate keys, a key belongs to the first peer
+// registering it until that peer disconnects, later registrations are refused.
+// It only moves opaque packets; the traffic it forwards is expected to be
+// end-to-end encrypted (QUIC in tunnel).
+package relay
+
+import (
+	"errors"
+	"fmt"
+)
+
+// KeyParam is the query parameter a peer registers its key with.
+const KeyParam = "key"
+
+const maxKeyLen = 255
+
+// ErrKeyTaken is returned by Dial when another peer holds the key.
+var ErrKeyTaken = errors.New("relay key already registered")
+
+// Addr is the address of a peer behind the relay.
+type Addr struct {
+	Key string
+}
+
+func (a Addr) Network() string { return "relay" }
+func (a Addr) String() string  { return a.Key }
+
+func encodePacket(key string, payload []byte) []byte {
+	frame := make([]byte, 0, 1+len(key)+len(payload))
+	frame = append(frame, byte(len(key)))
+	frame = append(frame, key...)
+	return append(frame, payload...)
+}
+
+func decodePacket(frame []byte) (string, []byte, error) {
+	if len(frame) < 1 || len(frame) < 1+int(frame[0]) {
+		return "", nil, fmt.Errorf("relay packet too short")
+	}
+	n := 1 + int(frame[0])
+	return string(frame[1:n]), frame[n:], nil
+}
+
+func validKey(key string) error {
+	if key == "" || len(key) > maxKeyLen {
+		return fmt.Errorf("relay key must be 1-%d bytes", maxKeyLen)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestServer(t *testing.T) string {
+	t.Helper()
+	srv := httptest.NewServer(NewServer())
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func dial(t *testing.T, url, key string) *Conn {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := Dial(ctx, url, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+func readPacket(t *testing.T, c *Conn) (string, Addr) {
+	t.Helper()
+	if err := c.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	n, addr, err := c.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n]), addr.(Addr)
+}
+
+func TestRoundTrip(t *testing.T) {
+	url := newTestServer(t)
+	a := dial(t, url, "a")
+	b := dial(t, url, "b")
+
+	if _, err := a.WriteTo([]byte("ping"), Addr{Key: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	msg, from := readPacket(t, b)
+	if msg != "ping" || from.Key != "a" {
+		t.Fatalf("got %q from %s, want ping from a", msg, from)
+	}
+	if _, err := b.WriteTo([]byte("pong"), from); err != nil {
+		t.Fatal(err)
+	}
+	msg, from = readPacket(t, a)
+	if msg != "pong" || from.Key != "b" {
+		t.Fatalf("got %q from %s, want pong from b", msg, from)
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	a := dial(t, newTestServer(t), "a")
+	if err := a.SetReadDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := a.ReadFrom(make([]byte, 10)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read error %v, want deadline exceeded", err)
+	}
+}
+
+func TestDuplicateKey(t *testing.T) {
+	url := newTestServer(t)
+	a := dial(t, url, "a")
+	b := dial(t, url, "b")
+
+	_, err := Dial(context.Background(), url, "a")
+	if !errors.Is(err, ErrKeyTaken) {
+		t.Fatalf("dial error %v, want %v", err, ErrKeyTaken)
+	}
+	// the peer holding the key is still reachable
+	if _, err = b.WriteTo([]byte("still here"), Addr{Key: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if msg, _ := readPacket(t, a); msg != "still here" {
+		t.Fatalf("got %q", msg)
+	}
+
+	// the key is free again once its peer left
+	_ = a.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c, err := Dial(context.Background(), url, "a")
+		if err == nil {
+			_ = c.Close()
+			break
+		}
+		if !errors.Is(err, ErrKeyTaken) || time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestInvalidKey(t *testing.T) {
+	srv := httptest.NewServer(NewServer())
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
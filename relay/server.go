@@ -0,0 +1,143 @@
+package relay
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// queueSize is how many packets may wait for a slow peer before new ones are
+// dropped, like a full router queue would.
+const queueSize = 256
+
+// Server is an http.Handler relaying packets between the WebSocket clients
+// registered on it. It can be mounted on any mux or started with httptest.
+type Server struct {
+	upgrader websocket.Upgrader
+	mu       sync.RWMutex
+	peers    map[string]*peer
+}
+
+type peer struct {
+	key  string
+	ws   *websocket.Conn
+	out  chan []byte
+	done chan struct{}
+	once sync.Once
+}
+
+func NewServer() *Server {
+	return &Server{
+		upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+		peers: map[string]*peer{},
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get(KeyParam)
+	if err := validKey(key); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p := &peer{
+		key:  key,
+		out:  make(chan []byte, queueSize),
+		done: make(chan struct{}),
+	}
+	if !s.register(p) {
+		http.Error(w, "key already registered", http.StatusConflict)
+		return
+	}
+	defer s.unregister(p)
+	ws, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	p.ws = ws
+	go p.writeLoop()
+	p.readLoop(s)
+}
+
+// register adds p unless its key is taken. Keys travel in the clear through
+// the signal, so a connection under a known key must not evict the peer
+// holding it; a reconnecting peer waits until its old connection is gone.
+func (s *Server) register(p *peer) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.peers[p.key] != nil {
+		return false
+	}
+	s.peers[p.key] = p
+	return true
+}
+
+func (s *Server) unregister(p *peer) {
+	s.mu.Lock()
+	if s.peers[p.key] == p {
+		delete(s.peers, p.key)
+	}
+	s.mu.Unlock()
+	p.close()
+}
+
+func (s *Server) lookup(key string) *peer {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.peers[key]
+}
+
+func (p *peer) readLoop(s *Server) {
+	for {
+		messageType, frame, err := p.ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		if messageType != websocket.BinaryMessage {
+			continue
+		}
+		dst, payload, err := decodePacket(frame)
+		if err != nil {
+			continue
+		}
+		target := s.lookup(dst)
+		if target == nil {
+			continue
+		}
+		target.send(encodePacket(p.key, payload))
+	}
+}
+
+func (p *peer) send(frame []byte) {
+	select {
+	case p.out <- frame:
+	case <-p.done:
+	default:
+		// queue full, drop the packet
+	}
+}
+
+func (p *peer) writeLoop() {
+	for {
+		select {
+		case <-p.done:
+			return
+		case frame := <-p.out:
+			if err := p.ws.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+				p.close()
+				return
+			}
+		}
+	}
+}
+
+func (p *peer) close() {
+	p.once.Do(func() {
+		close(p.done)
+		if p.ws != nil {
+			_ = p.ws.Close()
+		}
+	})
+}
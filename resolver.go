@@ -4,15 +4,20 @@ import (
 	"crypto/rand"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/pion/logging"
 	"github.com/pion/stun"
 	"github.com/pion/turn/v2"
 	"net"
+	"os"
 	"sync"
 	"time"
 )
 
+// stunAttempts is how often a binding request is sent before giving up.
+const stunAttempts = 3
+
 type request struct {
 	stun       string
 	changeIp   bool
@@ -56,6 +61,16 @@ type NATDetail struct {
 	LocalAddrs []string `json:"local_addrs"`
 	NATType    NATType  `json:"nat_type"`
 	Token      string   `json:"token"`
+	// PunchAt proposes when to start hole punching, in unix milliseconds of
+	// the NTP-corrected clock. Zero means start as soon as the signal is read.
+	PunchAt int64 `json:"punch_at,omitempty"`
+	// TCPAddr is the mapped address for TCP simultaneous open, empty
+	// unless the TCP fallback is enabled.
+	TCPAddr string `json:"tcp_addr,omitempty"`
+	// SDP and SDPType carry a WebRTC session description ("offer" or
+	// "answer"), only set by ConnectWebRTC.
+	SDP     string `json:"sdp,omitempty"`
+	SDPType string `json:"sdp_type,omitempty"`
 }
 
 type Resolver struct {
@@ -114,6 +129,64 @@ func (r Resolver) Resolve() (*NATDetail, error) {
 	}, nil
 }
 
+// stunMappedAddr returns the address the NAT currently maps conn to, without
+// running the full NAT type detection. Unlike a Resolver it reads the answers
+// itself and leaves no reader behind, so conn can be used on afterwards.
+func stunMappedAddr(conn *net.UDPConn) (string, error) {
+	var err error
+	for _, req := range stunServers[:2] {
+		var mappedAddr string
+		mappedAddr, err = stunBinding(conn, req.stun)
+		if err == nil {
+			return mappedAddr, nil
+		}
+		log.Debugf("stun %s error: %v\n", req.stun, err)
+	}
+	return "", err
+}
+
+// stunBinding sends a binding request to stunServer from conn, retrying like
+// the transactions of a Resolver, and returns the mapped address.
+func stunBinding(conn *net.UDPConn, stunServer string) (string, error) {
+	toAddr, err := net.ResolveUDPAddr("udp4", stunServer)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %s", stunServer, err)
+	}
+	msg, err := buildMsg(false, false)
+	if err != nil {
+		return "", err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+	buf := make([]byte, 1500)
+	for attempt := 0; attempt < stunAttempts; attempt++ {
+		if _, err = conn.WriteTo(msg.Raw, toAddr); err != nil {
+			return "", err
+		}
+		if err = conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+			return "", err
+		}
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			if err != nil {
+				return "", err
+			}
+			res := new(stun.Message)
+			if !udpAddrEqual(from, toAddr) || stun.Decode(buf[:n], res) != nil || res.TransactionID != msg.TransactionID {
+				continue
+			}
+			var mappedAddr stun.XORMappedAddress
+			if err = mappedAddr.GetFrom(res); err != nil {
+				return "", fmt.Errorf("failed to get MAPPED-ADDRESS: %s", err)
+			}
+			return mappedAddr.String(), nil
+		}
+	}
+	return "", fmt.Errorf("no response from %s", stunServer)
+}
+
 func (r Resolver) test(stunServer string, changeIp bool, changePort bool) (string, error) {
 	toAddr, err := net.ResolveUDPAddr("udp4", stunServer)
 	if err != nil {
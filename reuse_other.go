@@ -0,0 +1,13 @@
+//go:build !unix && !windows
+
+package tunnel
+
+import (
+	"syscall"
+)
+
+// reuseControl is a no-op where port sharing is unavailable,
+// TCP simultaneous open will then fail to bind its dials.
+func reuseControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,21 @@
+//go:build windows
+
+package tunnel
+
+import (
+	"syscall"
+)
+
+// reuseControl lets several TCP sockets share a local port, which TCP
+// simultaneous open needs for the STUN query, the listener and the dials.
+// Windows has no SO_REUSEPORT, SO_REUSEADDR already allows the sharing.
+func reuseControl(network, address string, c syscall.RawConn) error {
+	var opErr error
+	err := c.Control(func(fd uintptr) {
+		opErr = syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return opErr
+}
@@ -0,0 +1,50 @@
+package rpc
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+const version = "2.0"
+
+// Error codes of JSON-RPC 2.0.
+const (
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeInternalError  = -32603
+	// CodeCanceled answers a request the caller canceled.
+	CodeCanceled = -32800
+)
+
+// Error is a JSON-RPC error object. Handlers return it to choose the code
+// and data the caller sees, any other error becomes CodeInternalError.
+type Error struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("rpc error %d: %s", e.Code, e.Message)
+}
+
+// message is a request, notification or response. A request has Method and
+// ID, a notification Method only, a response ID and Result or Error.
+type message struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id,omitempty"`
+	Method  string           `json:"method,omitempty"`
+	Params  json.RawMessage  `json:"params,omitempty"`
+	Result  json.RawMessage  `json:"result,omitempty"`
+	Error   *Error           `json:"error,omitempty"`
+}
+
+// cancelMethod is the notification a caller sends when it gives up on a
+// request, as in the Language Server Protocol.
+const cancelMethod = "$/cancelRequest"
+
+type cancelParams struct {
+	ID json.RawMessage `json:"id"`
+}
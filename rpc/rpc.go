@@ -0,0 +1,372 @@
+// Package rpc runs JSON-RPC 2.0 between the two sides of a tunnel.Peer.
+// Both sides register methods and call the other's, the roles are symmetric
+// like the Peer's.
+//
+// Each side sends its requests and notifications on a message channel it
+// opens, named "jsonrpc", and reads the responses from it; the remote's
+// requests arrive on the channel the remote opens. A caller that gives up on
+// a request sends the notification "$/cancelRequest" with the request's id,
+// which cancels the context of the handler:
+//
+//	{"jsonrpc": "2.0", "method": "$/cancelRequest", "params": {"id": 7}}
+//
+// Batches are not supported.
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+
+	"tunnel"
+)
+
+// channelName is the name of the message channels carrying JSON-RPC.
+const channelName = "jsonrpc"
+
+// ErrClosed is returned by calls on a closed Conn, or whose connection to
+// the remote was lost before the response arrived.
+var ErrClosed = errors.New("rpc connection closed")
+
+// Handler serves a method. It returns the result, anything JSON encodable,
+// or an error, an *Error to choose its code. ctx is canceled when the caller
+// cancels the request or the connection is lost.
+type Handler func(ctx context.Context, params json.RawMessage) (any, error)
+
+// Conn calls the remote's methods and serves its own to the remote.
+type Conn struct {
+	peer *tunnel.Peer
+
+	methodMu sync.RWMutex
+	methods  map[string]Handler
+
+	outMu   sync.Mutex
+	out     *tunnel.Channel
+	nextID  uint64
+	pending map[uint64]chan *message
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// New serves JSON-RPC on peer. There is one Conn per Peer, a second one
+// takes the remote's requests over.
+func New(peer *tunnel.Peer) *Conn {
+	c := &Conn{
+		peer:    peer,
+		methods: map[string]Handler{},
+		pending: map[uint64]chan *message{},
+		closed:  make(chan struct{}),
+	}
+	peer.HandleChannel(channelName, c.serve)
+	return c
+}
+
+// Handle registers handler for method.
+func (c *Conn) Handle(method string, handler Handler) {
+	c.methodMu.Lock()
+	defer c.methodMu.Unlock()
+	c.methods[method] = handler
+}
+
+// Call calls method on the remote with params and decodes its result into
+// result, unless result is nil. Errors of the remote's handler are *Error.
+// Canceling ctx cancels the request on the remote too.
+func (c *Conn) Call(ctx context.Context, method string, params, result any) error {
+	raw, err := marshalParams(params)
+	if err != nil {
+		return err
+	}
+	out, id, resp, err := c.register(ctx)
+	if err != nil {
+		return err
+	}
+	rawID := json.RawMessage(strconv.FormatUint(id, 10))
+
+	err = out.SendJSON(&message{JSONRPC: version, ID: &rawID, Method: method, Params: raw})
+	if err != nil {
+		c.forget(id)
+		return err
+	}
+	select {
+	case m, ok := <-resp:
+		if !ok {
+			return ErrClosed
+		}
+		if m.Error != nil {
+			return m.Error
+		}
+		if result == nil {
+			return nil
+		}
+		return json.Unmarshal(m.Result, result)
+	case <-ctx.Done():
+		c.forget(id)
+		go func() {
+			params, _ := json.Marshal(cancelParams{ID: rawID})
+			_ = out.SendJSON(&message{JSONRPC: version, Method: cancelMethod, Params: params})
+		}()
+		return ctx.Err()
+	case <-c.closed:
+		return ErrClosed
+	}
+}
+
+// Notify calls method on the remote without waiting for, or getting, a result.
+func (c *Conn) Notify(ctx context.Context, method string, params any) error {
+	raw, err := marshalParams(params)
+	if err != nil {
+		return err
+	}
+	out, err := c.channel(ctx)
+	if err != nil {
+		return err
+	}
+	return out.SendJSON(&message{JSONRPC: version, Method: method, Params: raw})
+}
+
+// Close fails the pending calls and closes the channel of our requests.
+// The remote's requests are still served while the Peer lives.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	c.outMu.Lock()
+	out := c.out
+	c.outMu.Unlock()
+	if out == nil {
+		return nil
+	}
+	return out.Close()
+}
+
+// register adds a pending call on the channel of our requests. It is added
+// while that channel is still current, so readResponses fails it if the
+// channel goes away.
+func (c *Conn) register(ctx context.Context) (*tunnel.Channel, uint64, chan *message, error) {
+	for {
+		out, err := c.channel(ctx)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		c.outMu.Lock()
+		if c.out != out {
+			// lost since, open a new one
+			c.outMu.Unlock()
+			continue
+		}
+		c.nextID++
+		id := c.nextID
+		resp := make(chan *message, 1)
+		c.pending[id] = resp
+		c.outMu.Unlock()
+		return out, id, resp, nil
+	}
+}
+
+// channel returns the channel of our requests, opening it if needed.
+func (c *Conn) channel(ctx context.Context) (*tunnel.Channel, error) {
+	select {
+	case <-c.closed:
+		return nil, ErrClosed
+	default:
+	}
+	c.outMu.Lock()
+	out := c.out
+	c.outMu.Unlock()
+	if out != nil {
+		return out, nil
+	}
+	out, err := c.peer.OpenChannel(ctx, channelName)
+	if err != nil {
+		return nil, err
+	}
+	c.outMu.Lock()
+	select {
+	case <-c.closed:
+		c.outMu.Unlock()
+		_ = out.Close()
+		return nil, ErrClosed
+	default:
+	}
+	if c.out != nil {
+		// a concurrent call opened one first
+		current := c.out
+		c.outMu.Unlock()
+		_ = out.Close()
+		return current, nil
+	}
+	c.out = out
+	c.outMu.Unlock()
+	go c.readResponses(out)
+	return out, nil
+}
+
+// readResponses hands the responses on out to their calls. When out fails
+// the pending calls fail and the next call opens a new channel.
+func (c *Conn) readResponses(out *tunnel.Channel) {
+	defer func() {
+		_ = out.Close()
+		c.outMu.Lock()
+		defer c.outMu.Unlock()
+		if c.out == out {
+			c.out = nil
+		}
+		for id, resp := range c.pending {
+			close(resp)
+			delete(c.pending, id)
+		}
+	}()
+	for {
+		b, err := out.Receive()
+		if err != nil {
+			return
+		}
+		var m message
+		if json.Unmarshal(b, &m) != nil || m.ID == nil {
+			continue
+		}
+		id, err := strconv.ParseUint(string(*m.ID), 10, 64)
+		if err != nil {
+			continue
+		}
+		c.outMu.Lock()
+		resp := c.pending[id]
+		delete(c.pending, id)
+		c.outMu.Unlock()
+		if resp != nil {
+			resp <- &m
+		}
+	}
+}
+
+func (c *Conn) forget(id uint64) {
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+	delete(c.pending, id)
+}
+
+// serve runs the requests arriving on in, a channel the remote opened.
+func (c *Conn) serve(in *tunnel.Channel) {
+	ctx, cancelAll := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancelAll()
+
+	var mu sync.Mutex
+	running := map[string]context.CancelFunc{}
+	for {
+		b, err := in.Receive()
+		if err != nil {
+			return
+		}
+		var m message
+		if err = json.Unmarshal(b, &m); err != nil {
+			code := CodeParseError
+			if json.Valid(b) {
+				code = CodeInvalidRequest
+			}
+			reply(in, nil, nil, &Error{Code: code, Message: err.Error()})
+			continue
+		}
+		if m.JSONRPC != version || m.Method == "" {
+			if m.ID != nil {
+				reply(in, m.ID, nil, &Error{Code: CodeInvalidRequest, Message: "invalid request"})
+			}
+			continue
+		}
+		if m.Method == cancelMethod {
+			var p cancelParams
+			if json.Unmarshal(m.Params, &p) == nil {
+				mu.Lock()
+				if cancel := running[string(p.ID)]; cancel != nil {
+					cancel()
+				}
+				mu.Unlock()
+			}
+			continue
+		}
+
+		c.methodMu.RLock()
+		handler := c.methods[m.Method]
+		c.methodMu.RUnlock()
+		if handler == nil {
+			if m.ID != nil {
+				reply(in, m.ID, nil, &Error{Code: CodeMethodNotFound, Message: "method not found: " + m.Method})
+			}
+			continue
+		}
+		hctx, cancel := context.WithCancel(ctx)
+		if m.ID != nil {
+			mu.Lock()
+			running[string(*m.ID)] = cancel
+			mu.Unlock()
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := handler(hctx, m.Params)
+			canceled := hctx.Err() != nil
+			cancel()
+			if m.ID == nil {
+				return
+			}
+			mu.Lock()
+			delete(running, string(*m.ID))
+			mu.Unlock()
+			if canceled && err != nil {
+				// nobody waits for it anymore
+				err = &Error{Code: CodeCanceled, Message: "request canceled"}
+			}
+			reply(in, m.ID, result, err)
+		}()
+	}
+}
+
+// reply sends the response to the request id, with result or err.
+func reply(ch *tunnel.Channel, id *json.RawMessage, result any, err error) {
+	if id == nil {
+		null := json.RawMessage("null")
+		id = &null
+	}
+	m := &message{JSONRPC: version, ID: id}
+	if err == nil {
+		m.Result, err = json.Marshal(result)
+	}
+	if err != nil {
+		var rpcErr *Error
+		if !errors.As(err, &rpcErr) {
+			rpcErr = &Error{Code: CodeInternalError, Message: err.Error()}
+		}
+		m.Result, m.Error = nil, rpcErr
+	}
+	_ = ch.SendJSON(m)
+}
+
+func marshalParams(params any) (json.RawMessage, error) {
+	if params == nil {
+		return nil, nil
+	}
+	return json.Marshal(params)
+}
+
+// Register registers fn for method with typed params and result, params
+// that do not decode into P are answered with CodeInvalidParams.
+func Register[P, R any](c *Conn, method string, fn func(ctx context.Context, params P) (R, error)) {
+	c.Handle(method, func(ctx context.Context, raw json.RawMessage) (any, error) {
+		var params P
+		if len(raw) > 0 {
+			if err := json.Unmarshal(raw, &params); err != nil {
+				return nil, &Error{Code: CodeInvalidParams, Message: err.Error()}
+			}
+		}
+		return fn(ctx, params)
+	})
+}
+
+// Call calls method on the remote and returns its result as R.
+func Call[R any](ctx context.Context, c *Conn, method string, params any) (R, error) {
+	var result R
+	err := c.Call(ctx, method, params, &result)
+	return result, err
+}
@@ -0,0 +1,327 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"tunnel"
+)
+
+func newPair(t *testing.T) (*tunnel.Peer, *Conn, *tunnel.Peer, *Conn) {
+	t.Helper()
+	pa, pb := tunnel.Pipe()
+	a, b := New(pa), New(pb)
+	t.Cleanup(func() {
+		_ = a.Close()
+		_ = b.Close()
+		_ = pa.Close()
+		_ = pb.Close()
+	})
+	return pa, a, pb, b
+}
+
+// rawChannel opens a request channel from p to the remote's Conn, to speak
+// the wire format without a Conn of our own.
+func rawChannel(t *testing.T, p *tunnel.Peer) *tunnel.Channel {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ch, err := p.OpenChannel(ctx, channelName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ch.Close() })
+	_ = ch.SetReadDeadline(time.Now().Add(10 * time.Second))
+	return ch
+}
+
+func receive(t *testing.T, ch *tunnel.Channel) *message {
+	t.Helper()
+	var m message
+	if err := ch.ReceiveJSON(&m); err != nil {
+		t.Fatal(err)
+	}
+	return &m
+}
+
+func TestCall(t *testing.T) {
+	_, a, _, b := newPair(t)
+	type addParams struct{ X, Y int }
+	Register(b, "add", func(ctx context.Context, p addParams) (int, error) {
+		return p.X + p.Y, nil
+	})
+	Register(a, "greet", func(ctx context.Context, name string) (string, error) {
+		return "hello " + name, nil
+	})
+	b.Handle("fail", func(ctx context.Context, params json.RawMessage) (any, error) {
+		return nil, &Error{Code: 42, Message: "failed", Data: json.RawMessage(`{"why":"test"}`)}
+	})
+	b.Handle("plain", func(ctx context.Context, params json.RawMessage) (any, error) {
+		return nil, errors.New("plain error")
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// concurrent first calls race to open the channel
+	var wg sync.WaitGroup
+	errs := make(chan error, 32)
+	for i := range 32 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n, err := Call[int](ctx, a, "add", addParams{i, i})
+			if err == nil && n != 2*i {
+				err = fmt.Errorf("add(%d, %d) = %d", i, i, n)
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the other way round, on the channel b opens
+	if s, err := Call[string](ctx, b, "greet", "b"); err != nil || s != "hello b" {
+		t.Fatalf("greet = %q, %v", s, err)
+	}
+
+	tests := []struct {
+		method string
+		params any
+		code   int
+	}{
+		{"add", []int{1, 2}, CodeInvalidParams},
+		{"fail", nil, 42},
+		{"plain", nil, CodeInternalError},
+	}
+	for _, tt := range tests {
+		var rpcErr *Error
+		err := a.Call(ctx, tt.method, tt.params, nil)
+		if !errors.As(err, &rpcErr) || rpcErr.Code != tt.code {
+			t.Errorf("%s: error %v, want code %d", tt.method, err, tt.code)
+		}
+	}
+}
+
+func TestNotify(t *testing.T) {
+	_, a, _, b := newPair(t)
+	got := make(chan string, 3)
+	b.Handle("log", func(ctx context.Context, params json.RawMessage) (any, error) {
+		var line string
+		_ = json.Unmarshal(params, &line)
+		got <- line
+		return "ignored", nil
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, line := range []string{"one", "two", "three"} {
+		if err := a.Notify(ctx, "log", line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	seen := map[string]bool{}
+	for range 3 {
+		select {
+		case line := <-got:
+			seen[line] = true
+		case <-ctx.Done():
+			t.Fatalf("notifications delivered: %v", seen)
+		}
+	}
+	if !seen["one"] || !seen["two"] || !seen["three"] {
+		t.Fatalf("notifications delivered: %v", seen)
+	}
+}
+
+// TestCancelRequest sends $/cancelRequest as the wire format has it, the
+// handler's context ends and the request is answered as canceled.
+func TestCancelRequest(t *testing.T) {
+	pa, _, _, b := newPair(t)
+	started := make(chan struct{}, 1)
+	b.Handle("wait", func(ctx context.Context, params json.RawMessage) (any, error) {
+		started <- struct{}{}
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	ch := rawChannel(t, pa)
+
+	if err := ch.Send([]byte(`{"jsonrpc":"2.0","id":"job-7","method":"wait"}`)); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	// canceling an id that is not running is ignored
+	for _, id := range []string{`"job-8"`, `"job-7"`} {
+		note := fmt.Sprintf(`{"jsonrpc":"2.0","method":%q,"params":{"id":%s}}`, cancelMethod, id)
+		if err := ch.Send([]byte(note)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := receive(t, ch)
+	if m.ID == nil || string(*m.ID) != `"job-7"` || m.Error == nil || m.Error.Code != CodeCanceled {
+		t.Fatalf("response %+v, want job-7 canceled", m)
+	}
+}
+
+// TestCallCanceled cancels a Call, which sends $/cancelRequest for it.
+func TestCallCanceled(t *testing.T) {
+	_, a, _, b := newPair(t)
+	canceled := make(chan error, 1)
+	b.Handle("wait", func(ctx context.Context, params json.RawMessage) (any, error) {
+		<-ctx.Done()
+		canceled <- ctx.Err()
+		return nil, ctx.Err()
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := a.Call(ctx, "wait", nil, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("call: %v, want %v", err, context.DeadlineExceeded)
+	}
+	select {
+	case err := <-canceled:
+		// canceled by the remote's notification, not a deadline of its own
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("handler context: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler not canceled")
+	}
+}
+
+func TestInvalidMessages(t *testing.T) {
+	pa, _, _, b := newPair(t)
+	b.Handle("known", func(ctx context.Context, params json.RawMessage) (any, error) {
+		return true, nil
+	})
+	ch := rawChannel(t, pa)
+
+	tests := []struct {
+		name string
+		msg  string
+		// wantID is the id answered with, raw JSON
+		wantID string
+		code   int
+	}{
+		{"parse error", `{"jsonrpc":"2.0","id":1,`, "null", CodeParseError},
+		{"not an object", `[1, 2]`, "null", CodeInvalidRequest},
+		{"wrong version", `{"jsonrpc":"1.0","id":2,"method":"known"}`, "2", CodeInvalidRequest},
+		{"no method", `{"jsonrpc":"2.0","id":3}`, "3", CodeInvalidRequest},
+		{"unknown method", `{"jsonrpc":"2.0","id":"x","method":"unknown"}`, `"x"`, CodeMethodNotFound},
+		// a notification of an unknown method gets no answer, the next
+		// response is the known method's
+		{"unknown notification", `{"jsonrpc":"2.0","method":"unknown"}`, "", 0},
+		{"known", `{"jsonrpc":"2.0","id":4,"method":"known"}`, "4", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ch.Send([]byte(tt.msg)); err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantID == "" {
+				return
+			}
+			b, err := ch.Receive()
+			if err != nil {
+				t.Fatal(err)
+			}
+			// decoded by hand, a null id has to be sent rather than left out
+			var m struct {
+				JSONRPC string          `json:"jsonrpc"`
+				ID      json.RawMessage `json:"id"`
+				Error   *Error          `json:"error"`
+			}
+			if err = json.Unmarshal(b, &m); err != nil {
+				t.Fatal(err)
+			}
+			if m.JSONRPC != version || string(m.ID) != tt.wantID {
+				t.Fatalf("response %s, want id %s", b, tt.wantID)
+			}
+			switch {
+			case tt.code == 0 && m.Error != nil:
+				t.Fatalf("error %v", m.Error)
+			case tt.code != 0 && (m.Error == nil || m.Error.Code != tt.code):
+				t.Fatalf("error %v, want code %d", m.Error, tt.code)
+			}
+		})
+	}
+}
+
+// TestChannelLost loses the channel of a's requests: the pending call fails,
+// the next one registers on a new channel.
+func TestChannelLost(t *testing.T) {
+	_, a, _, b := newPair(t)
+	started := make(chan struct{})
+	b.Handle("wait", func(ctx context.Context, params json.RawMessage) (any, error) {
+		close(started)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	Register(b, "ping", func(ctx context.Context, _ any) (string, error) {
+		return "pong", nil
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result := make(chan error, 1)
+	go func() { result <- a.Call(ctx, "wait", nil, nil) }()
+	<-started
+	a.outMu.Lock()
+	lost := a.out
+	a.outMu.Unlock()
+	_ = lost.Close()
+	if err := <-result; !errors.Is(err, ErrClosed) {
+		t.Fatalf("pending call: %v, want %v", err, ErrClosed)
+	}
+
+	if s, err := Call[string](ctx, a, "ping", nil); err != nil || s != "pong" {
+		t.Fatalf("ping after the channel was lost = %q, %v", s, err)
+	}
+	a.outMu.Lock()
+	current := a.out
+	a.outMu.Unlock()
+	if current == nil || current == lost {
+		t.Fatal("call did not open a new channel")
+	}
+}
+
+func TestRemoteLost(t *testing.T) {
+	_, a, pb, b := newPair(t)
+	started := make(chan struct{})
+	b.Handle("wait", func(ctx context.Context, params json.RawMessage) (any, error) {
+		close(started)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result := make(chan error, 1)
+	go func() { result <- a.Call(ctx, "wait", nil, nil) }()
+	<-started
+	_ = pb.Close()
+	select {
+	case err := <-result:
+		if !errors.Is(err, ErrClosed) {
+			t.Fatalf("call: %v, want %v", err, ErrClosed)
+		}
+	case <-ctx.Done():
+		t.Fatal("call still pending after the remote was lost")
+	}
+}
+
+func TestClosed(t *testing.T) {
+	_, a, _, _ := newPair(t)
+	_ = a.Close()
+	if err := a.Call(context.Background(), "any", nil, nil); !errors.Is(err, ErrClosed) {
+		t.Fatalf("call: %v, want %v", err, ErrClosed)
+	}
+	if err := a.Notify(context.Background(), "any", nil); !errors.Is(err, ErrClosed) {
+		t.Fatalf("notify: %v, want %v", err, ErrClosed)
+	}
+}
@@ -0,0 +1,269 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SOCKS5, RFC 1928. Only the no authentication method is offered: the proxy
+// is meant to listen on localhost, the remote's AllowForward list decides
+// which destinations are reachable.
+const (
+	socksVersion = 5
+
+	socksNoAuth       = 0
+	socksNoAcceptable = 0xff
+
+	socksConnect      = 1
+	socksUDPAssociate = 3
+
+	socksAddrIPv4   = 1
+	socksAddrDomain = 3
+	socksAddrIPv6   = 4
+
+	socksSucceeded          = 0
+	socksGeneralFailure     = 1
+	socksNotAllowed         = 2
+	socksHostUnreachable    = 4
+	socksCommandUnsupported = 7
+)
+
+// socksHandshakeTimeout bounds the greeting and request of a SOCKS client.
+const socksHandshakeTimeout = time.Second * 10
+
+var errSocksVersion = errors.New("unsupported socks version")
+
+// ListenSOCKS5 runs a SOCKS5 proxy on addr whose connections egress from the
+// remote: CONNECT dials the destination on the remote, UDP ASSOCIATE sends
+// the datagrams from the remote as forwarded UDP flows. Destinations are
+// subject to the remote's AllowForward list, e.g. "*:*" to allow all.
+// Closing the returned listener stops the proxy.
+func (p *Peer) ListenSOCKS5(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				if err := p.serveSOCKS(conn); err != nil {
+					log.Debugf("socks %s error: %s\n", conn.RemoteAddr(), err)
+				}
+			}()
+		}
+	}()
+	return ln, nil
+}
+
+func (p *Peer) serveSOCKS(conn net.Conn) error {
+	_ = conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	cmd, target, err := socksHandshake(conn)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	switch cmd {
+	case socksConnect:
+		return p.socksConnect(conn, target)
+	case socksUDPAssociate:
+		return p.socksUDPAssociate(conn)
+	}
+	_ = writeSocksReply(conn, socksCommandUnsupported, nil)
+	_ = conn.Close()
+	return fmt.Errorf("unsupported socks command %d", cmd)
+}
+
+// socksHandshake negotiates the method and reads the request of a client.
+func socksHandshake(conn net.Conn) (byte, string, error) {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		return 0, "", err
+	}
+	if hdr[0] != socksVersion {
+		return 0, "", errSocksVersion
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return 0, "", err
+	}
+	if bytes.IndexByte(methods, socksNoAuth) < 0 {
+		_, _ = conn.Write([]byte{socksVersion, socksNoAcceptable})
+		return 0, "", errors.New("socks client requires authentication")
+	}
+	if _, err := conn.Write([]byte{socksVersion, socksNoAuth}); err != nil {
+		return 0, "", err
+	}
+
+	req := make([]byte, 3)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return 0, "", err
+	}
+	if req[0] != socksVersion {
+		return 0, "", errSocksVersion
+	}
+	target, _, err := readSocksAddr(conn)
+	if err != nil {
+		return 0, "", err
+	}
+	return req[1], target, nil
+}
+
+func (p *Peer) socksConnect(conn net.Conn, target string) error {
+	s, err := p.dialRemote(target)
+	if err != nil {
+		rep := byte(socksHostUnreachable)
+		if errors.Is(err, errForwardDenied) {
+			rep = socksNotAllowed
+		}
+		_ = writeSocksReply(conn, rep, nil)
+		_ = conn.Close()
+		return err
+	}
+	if err = writeSocksReply(conn, socksSucceeded, nil); err != nil {
+		_ = conn.Close()
+		_ = s.Close()
+		return err
+	}
+	pipe(conn, s.Conn)
+	return nil
+}
+
+// socksUDPAssociate relays the client's datagrams through a UDP flow per
+// destination until the client closes the TCP connection.
+func (p *Peer) socksUDPAssociate(conn net.Conn) error {
+	defer conn.Close()
+	ip := conn.LocalAddr().(*net.TCPAddr).IP
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+	if err != nil {
+		_ = writeSocksReply(conn, socksGeneralFailure, nil)
+		return err
+	}
+	defer pc.Close()
+	if err = writeSocksReply(conn, socksSucceeded, pc.LocalAddr().(*net.UDPAddr)); err != nil {
+		return err
+	}
+	go func() {
+		// the association ends with the TCP connection
+		_, _ = io.Copy(io.Discard, conn)
+		_ = pc.Close()
+	}()
+
+	done := make(chan struct{})
+	defer close(done)
+	var mu sync.Mutex
+	dests := map[string]chan []byte{}
+	clientIP := conn.RemoteAddr().(*net.TCPAddr).IP
+	buf := make([]byte, maxUDPPacket)
+	for {
+		n, client, err := pc.ReadFromUDP(buf)
+		if err != nil {
+			return nil
+		}
+		if !client.IP.Equal(clientIP) {
+			continue
+		}
+		// 2 bytes reserved, 1 byte fragment, address, data
+		if n < 4 || buf[2] != 0 {
+			// fragmentation is not supported, drop
+			continue
+		}
+		r := bytes.NewReader(buf[3:n])
+		target, rawAddr, err := readSocksAddr(r)
+		if err != nil {
+			continue
+		}
+		payload := append([]byte(nil), buf[n-r.Len():n]...)
+
+		mu.Lock()
+		out, ok := dests[target]
+		if !ok {
+			out = make(chan []byte, udpQueueSize)
+			dests[target] = out
+			// replies carry the destination as the client addressed it
+			hdr := append([]byte{0, 0, 0}, rawAddr...)
+			go func() {
+				p.serveUDPClient(out, done, func(ctx context.Context, deliver func([]byte)) (*udpFlow, error) {
+					return p.openUDPFlow(ctx, udpFlowTarget, target, deliver)
+				}, func(b []byte) {
+					_, _ = pc.WriteToUDP(append(hdr[:len(hdr):len(hdr)], b...), client)
+				})
+				mu.Lock()
+				delete(dests, target)
+				mu.Unlock()
+			}()
+		}
+		mu.Unlock()
+		select {
+		case out <- payload:
+		default:
+			// flow too slow, drop the datagram
+		}
+	}
+}
+
+// readSocksAddr reads an address type, address and port, it returns them as
+// host:port and in their raw encoding.
+func readSocksAddr(r io.Reader) (string, []byte, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", nil, err
+	}
+	var host string
+	raw := atyp
+	switch atyp[0] {
+	case socksAddrIPv4, socksAddrIPv6:
+		ip := make([]byte, net.IPv4len)
+		if atyp[0] == socksAddrIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", nil, err
+		}
+		host = net.IP(ip).String()
+		raw = append(raw, ip...)
+	case socksAddrDomain:
+		domain, err := readString(r)
+		if err != nil {
+			return "", nil, err
+		}
+		host = domain
+		raw = appendString(raw, domain)
+	default:
+		return "", nil, fmt.Errorf("unknown socks address type %d", atyp[0])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", nil, err
+	}
+	raw = append(raw, port...)
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), raw, nil
+}
+
+// writeSocksReply answers a request, with the bound address addr or 0.0.0.0:0.
+func writeSocksReply(w io.Writer, rep byte, addr *net.UDPAddr) error {
+	b := []byte{socksVersion, rep, 0}
+	if addr == nil {
+		addr = &net.UDPAddr{IP: net.IPv4zero}
+	}
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		b = append(append(b, socksAddrIPv4), ip4...)
+	} else {
+		b = append(append(b, socksAddrIPv6), addr.IP.To16()...)
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(addr.Port))
+	_, err := w.Write(b)
+	return err
+}
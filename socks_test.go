@@ -0,0 +1,201 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// appendSocksAddr encodes host:port the way a client addresses it, hosts
+// that are no IP go as domain.
+func appendSocksAddr(t *testing.T, b []byte, target string) []byte {
+	t.Helper()
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := net.ParseIP(host).To4(); ip != nil {
+		b = append(append(b, socksAddrIPv4), ip...)
+	} else {
+		b = appendString(append(b, socksAddrDomain), host)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(n))
+}
+
+// socksRequest greets the proxy at addr with methods, sends cmd for target
+// and returns the connection with the reply code and bound address.
+func socksRequest(t *testing.T, addr string, methods []byte, cmd byte, target string) (net.Conn, byte, string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	greeting := append([]byte{socksVersion, byte(len(methods))}, methods...)
+	if _, err = conn.Write(greeting); err != nil {
+		t.Fatal(err)
+	}
+	method := make([]byte, 2)
+	if _, err = io.ReadFull(conn, method); err != nil {
+		t.Fatal(err)
+	}
+	if method[1] != socksNoAuth {
+		return conn, method[1], ""
+	}
+	req := appendSocksAddr(t, []byte{socksVersion, cmd, 0}, target)
+	if _, err = conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	rep := make([]byte, 3)
+	if _, err = io.ReadFull(conn, rep); err != nil {
+		t.Fatal(err)
+	}
+	bound, _, err := readSocksAddr(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, rep[1], bound
+}
+
+func TestSOCKS5Connect(t *testing.T) {
+	for _, pp := range peerPairs {
+		t.Run(pp.name, func(t *testing.T) {
+			a, b := pp.pair(t)
+			echo := listenEcho(t)
+			_, port, _ := net.SplitHostPort(echo)
+			b.AllowForward(echo, "localhost:"+port)
+			ln, err := a.ListenSOCKS5("127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+
+			for _, target := range []string{echo, "localhost:" + port} {
+				conn, rep, _ := socksRequest(t, ln.Addr().String(), []byte{socksNoAuth}, socksConnect, target)
+				if rep != socksSucceeded {
+					t.Fatalf("connect %s: reply %d", target, rep)
+				}
+				msg := []byte("through " + target)
+				if _, err = conn.Write(msg); err != nil {
+					t.Fatal(err)
+				}
+				_ = conn.(*net.TCPConn).CloseWrite()
+				_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+				got, err := io.ReadAll(conn)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, msg) {
+					t.Fatalf("connect %s: echoed %q", target, got)
+				}
+			}
+		})
+	}
+}
+
+func TestSOCKS5Replies(t *testing.T) {
+	a, b := newPeerPair(t)
+	b.AllowForward("127.0.0.1:1")
+	ln, err := a.ListenSOCKS5("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	tests := []struct {
+		name    string
+		methods []byte
+		cmd     byte
+		target  string
+		want    byte
+	}{
+		{"authentication only", []byte{2}, socksConnect, "127.0.0.1:80", socksNoAcceptable},
+		{"not allowed", []byte{2, socksNoAuth}, socksConnect, "127.0.0.1:80", socksNotAllowed},
+		{"unreachable", []byte{socksNoAuth}, socksConnect, "127.0.0.1:1", socksHostUnreachable},
+		{"bind", []byte{socksNoAuth}, 2, "127.0.0.1:80", socksCommandUnsupported},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, rep, _ := socksRequest(t, ln.Addr().String(), tt.methods, tt.cmd, tt.target)
+			if rep != tt.want {
+				t.Fatalf("reply %d, want %d", rep, tt.want)
+			}
+			// the proxy hangs up on every failed request
+			_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if n, err := conn.Read(make([]byte, 1)); err != io.EOF {
+				t.Fatalf("read %d bytes, %v after the reply", n, err)
+			}
+		})
+	}
+}
+
+func TestSOCKS5UDPAssociate(t *testing.T) {
+	for _, pp := range peerPairs {
+		t.Run(pp.name, func(t *testing.T) {
+			a, b := pp.pair(t)
+			echo := listenUDPEcho(t)
+			b.AllowForward(echo)
+			ln, err := a.ListenSOCKS5("127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+
+			ctrl, rep, relay := socksRequest(t, ln.Addr().String(), []byte{socksNoAuth}, socksUDPAssociate, "0.0.0.0:0")
+			if rep != socksSucceeded {
+				t.Fatalf("udp associate: reply %d", rep)
+			}
+			conn, err := net.Dial("udp", relay)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			hdr := appendSocksAddr(t, []byte{0, 0, 0}, echo)
+			packet := append(hdr, "associated"...)
+			buf := make([]byte, maxUDPPacket)
+			var reply []byte
+			for deadline := time.Now().Add(10 * time.Second); reply == nil; {
+				if time.Now().After(deadline) {
+					t.Fatal("no reply through the association")
+				}
+				if _, err = conn.Write(packet); err != nil {
+					t.Fatal(err)
+				}
+				_ = conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+				if n, err := conn.Read(buf); err == nil {
+					reply = buf[:n]
+				}
+			}
+			// the reply is addressed from the destination as it was asked for
+			if !bytes.HasPrefix(reply, hdr) || !bytes.HasSuffix(reply, []byte(" associated")) {
+				t.Fatalf("reply %q", reply)
+			}
+
+			// closing the control connection ends the association
+			_ = ctrl.Close()
+			for deadline := time.Now().Add(5 * time.Second); ; {
+				_, _ = conn.Write(packet)
+				_ = conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+				// the relay port is gone once the reads are refused
+				var netErr net.Error
+				if _, err = conn.Read(buf); err != nil && !(errors.As(err, &netErr) && netErr.Timeout()) {
+					return
+				}
+				if time.Now().After(deadline) {
+					t.Fatal("association outlived its control connection")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,204 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/quicvarint"
+)
+
+// Every stream a Peer opens starts with a header naming its protocol:
+//
+//	varint  rawStreamFrameType, an HTTP/3 frame type unknown to HTTP/3,
+//	        so an HTTP/3 server hands the stream back to us
+//	1 byte  protocol length
+//	n bytes protocol
+//
+// HTTP/2 itself runs on streams with protocol http2Protocol. HTTP/3 request
+// streams are opened by the HTTP/3 client and carry no header.
+const rawStreamFrameType = 0x54554e
+
+// reservedPrefix marks the protocols tunnel uses itself, they cannot be used
+// with OpenStream and HandleStream.
+const reservedPrefix = "tunnel/"
+
+// http2Protocol is the protocol of the streams carrying HTTP/2.
+const http2Protocol = reservedPrefix + "h2"
+
+const maxProtocolLen = 255
+
+// streamHeaderTimeout bounds how long an inbound stream may take to send its header.
+const streamHeaderTimeout = time.Second * 10
+
+var errStreamHeader = errors.New("invalid stream header")
+
+// Stream is a raw bidirectional stream multiplexed with HTTP on the Peer's connection.
+type Stream struct {
+	net.Conn
+	// Protocol is the name the opening side gave the stream.
+	Protocol string
+}
+
+// HandleStream registers a handler for inbound streams of protocol. Streams
+// of protocols without a handler are returned by AcceptStream. The handler
+// owns the stream and has to close it. It panics for a reserved protocol.
+func (p *Peer) HandleStream(protocol string, handler func(*Stream)) {
+	if err := validProtocol(protocol); err != nil {
+		panic(err)
+	}
+	p.handleStream(protocol, handler)
+}
+
+func (p *Peer) handleStream(protocol string, handler func(*Stream)) {
+	p.streamMu.Lock()
+	defer p.streamMu.Unlock()
+	p.streamHandlers[protocol] = handler
+}
+
+// OpenStream opens a stream to the remote, which receives it from the handler
+// registered for protocol or from AcceptStream.
+func (p *Peer) OpenStream(ctx context.Context, protocol string) (*Stream, error) {
+	if err := validProtocol(protocol); err != nil {
+		return nil, err
+	}
+	return p.openStream(ctx, protocol)
+}
+
+func (p *Peer) openStream(ctx context.Context, protocol string) (*Stream, error) {
+	conn, err := p.tr.OpenStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err = writeStreamHeader(conn, protocol); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return &Stream{Conn: conn, Protocol: protocol}, nil
+}
+
+// AcceptStream returns the next inbound stream whose protocol has no handler.
+func (p *Peer) AcceptStream(ctx context.Context) (*Stream, error) {
+	select {
+	case s := <-p.streams:
+		return s, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-p.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// acceptStreams dispatches the streams the remote opens until the transport closes.
+func (p *Peer) acceptStreams(ctx context.Context) {
+	for {
+		conn, err := p.tr.AcceptStream(ctx)
+		if err != nil {
+			log.Debugf("accept stream error: %s\n", err)
+			p.finish(err)
+			return
+		}
+		go p.serveStream(conn, false)
+	}
+}
+
+// streamHijacker picks our streams out of the ones an HTTP/3 server accepts.
+func (p *Peer) streamHijacker(ft http3.FrameType, conn quic.Connection, str quic.Stream, err error) (bool, error) {
+	if err != nil || ft != rawStreamFrameType {
+		return false, nil
+	}
+	go p.serveStream(newQuicStreamConn(str, conn), true)
+	return true, nil
+}
+
+// serveStream reads the header of an inbound stream and hands the stream to
+// HTTP/2, the protocol's handler or AcceptStream. The HTTP/3 server already
+// read the frame type of its streams.
+func (p *Peer) serveStream(conn net.Conn, frameTypeRead bool) {
+	_ = conn.SetReadDeadline(time.Now().Add(streamHeaderTimeout))
+	protocol, err := readStreamHeader(conn, frameTypeRead)
+	if err != nil {
+		log.Debugf("read stream header error: %s\n", err)
+		_ = conn.Close()
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	if protocol == http2Protocol && p.h2conns != nil {
+		select {
+		case p.h2conns <- conn:
+		case <-p.closing:
+			_ = conn.Close()
+		case <-p.done:
+			_ = conn.Close()
+		}
+		return
+	}
+	s := &Stream{Conn: conn, Protocol: protocol}
+	p.streamMu.RLock()
+	handler := p.streamHandlers[protocol]
+	p.streamMu.RUnlock()
+	if handler != nil {
+		handler(s)
+		return
+	}
+	select {
+	case p.streams <- s:
+	case <-p.done:
+		_ = conn.Close()
+	}
+}
+
+func validProtocol(protocol string) error {
+	if protocol == "" || len(protocol) > maxProtocolLen {
+		return fmt.Errorf("protocol must be 1-%d bytes", maxProtocolLen)
+	}
+	if strings.HasPrefix(protocol, reservedPrefix) {
+		return fmt.Errorf("protocol %s is reserved", protocol)
+	}
+	return nil
+}
+
+func writeStreamHeader(w io.Writer, protocol string) error {
+	b := quicvarint.Append(nil, rawStreamFrameType)
+	_, err := w.Write(appendString(b, protocol))
+	return err
+}
+
+func readStreamHeader(r io.Reader, frameTypeRead bool) (string, error) {
+	if !frameTypeRead {
+		ft, err := quicvarint.Read(quicvarint.NewReader(r))
+		if err != nil {
+			return "", err
+		}
+		if ft != rawStreamFrameType {
+			return "", errStreamHeader
+		}
+	}
+	return readString(r)
+}
+
+// appendString appends s prefixed with its 1 byte length, s is at most 255 bytes.
+func appendString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)))
+	return append(b, s...)
+}
+
+// readString reads a string prefixed with its 1 byte length.
+func readString(r io.Reader) (string, error) {
+	n := make([]byte, 1)
+	if _, err := io.ReadFull(r, n); err != nil {
+		return "", err
+	}
+	s := make([]byte, n[0])
+	if _, err := io.ReadFull(r, s); err != nil {
+		return "", err
+	}
+	return string(s), nil
+}
@@ -0,0 +1,109 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStreams(t *testing.T) {
+	for _, pp := range peerPairs {
+		t.Run(pp.name, func(t *testing.T) {
+			a, b := pp.pair(t)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			b.HandleStream("upper", func(s *Stream) {
+				defer s.Close()
+				req, _ := io.ReadAll(s)
+				_, _ = s.Write(bytes.ToUpper(req))
+			})
+			b.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+				_, _ = io.WriteString(w, "http")
+			})
+
+			// streams run side by side with each other and HTTP
+			var wg sync.WaitGroup
+			for i := range 4 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					s, err := a.OpenStream(ctx, "upper")
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					defer s.Close()
+					msg := fmt.Sprintf("stream %d", i)
+					if _, err = io.WriteString(s, msg); err != nil {
+						t.Error(err)
+						return
+					}
+					if err = s.Conn.(closeWriter).CloseWrite(); err != nil {
+						t.Error(err)
+						return
+					}
+					got, err := io.ReadAll(s)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if want := bytes.ToUpper([]byte(msg)); !bytes.Equal(got, want) {
+						t.Errorf("got %q, want %q", got, want)
+					}
+				}()
+			}
+			resp, err := a.Client.Get("https://tunnel/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = resp.Body.Close()
+			wg.Wait()
+		})
+	}
+}
+
+func TestAcceptStream(t *testing.T) {
+	a, b := newPeerPair(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	b.HandleStream("handled", func(s *Stream) { _ = s.Close() })
+
+	for _, protocol := range []string{"handled", "chat/1", "files/1"} {
+		s, err := a.OpenStream(ctx, protocol)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+	}
+	// only the streams without a handler reach AcceptStream
+	accepted := map[string]bool{}
+	for range 2 {
+		s, err := b.AcceptStream(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = s.Close()
+		accepted[s.Protocol] = true
+	}
+	if !accepted["chat/1"] || !accepted["files/1"] {
+		t.Fatalf("accepted %v", accepted)
+	}
+}
+
+func TestReservedStreamProtocol(t *testing.T) {
+	a, _ := newPeerPair(t)
+	if _, err := a.OpenStream(context.Background(), reservedPrefix+"mine"); err == nil {
+		t.Fatal("opened a stream with a reserved protocol")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("handled a reserved protocol")
+		}
+	}()
+	a.HandleStream(reservedPrefix+"mine", func(s *Stream) {})
+}
@@ -0,0 +1,329 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/pion/stun"
+)
+
+// tcpStunServers answer STUN binding requests over TCP (RFC 5389 section 7.2.2).
+var tcpStunServers = []string{
+	"stun.nextcloud.com:443",
+	"stun.sipgate.net:3478",
+}
+
+const tcpStunTimeout = time.Second * 3
+
+// tcpPunchTimeout bounds TCP simultaneous open, it starts after UDP punching gave up.
+const tcpPunchTimeout = time.Second * 10
+
+// WithTCPFallback punches a TCP connection with simultaneous open when UDP
+// hole punching fails, e.g. on networks dropping all UDP. HTTP/2 then runs
+// over TLS and a stream multiplexer on that single connection.
+func WithTCPFallback() Option {
+	return func(t *Tunnel) {
+		t.tcpFallback = true
+	}
+}
+
+// listenTCP binds the port used for both the TCP STUN query and the
+// simultaneous open, and resolves its mapped address.
+func (t *Tunnel) listenTCP() (string, error) {
+	lc := net.ListenConfig{Control: reuseControl}
+	ln, err := lc.Listen(t.ctx, "tcp4", "0.0.0.0:0")
+	if err != nil {
+		return "", err
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	var mappedAddr string
+	for _, server := range tcpStunServers {
+		mappedAddr, err = tcpMappedAddr(t.ctx, port, server)
+		if err == nil {
+			break
+		}
+		log.Debugf("tcp stun %s error: %v\n", server, err)
+	}
+	if err != nil {
+		_ = ln.Close()
+		return "", err
+	}
+	t.tcpListener = ln
+	return mappedAddr, nil
+}
+
+// tcpMappedAddr sends a STUN binding request over TCP from the given local port.
+func tcpMappedAddr(ctx context.Context, port int, server string) (string, error) {
+	d := net.Dialer{
+		LocalAddr: &net.TCPAddr{Port: port},
+		Control:   reuseControl,
+		Timeout:   tcpStunTimeout,
+	}
+	conn, err := d.DialContext(ctx, "tcp4", server)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if err = conn.SetDeadline(time.Now().Add(tcpStunTimeout)); err != nil {
+		return "", err
+	}
+	req, err := buildMsg(false, false)
+	if err != nil {
+		return "", err
+	}
+	if _, err = conn.Write(req.Raw); err != nil {
+		return "", err
+	}
+	// message format:
+	// 2 bytes type
+	// 2 bytes length, not including the header
+	// 16 bytes magic cookie and transaction id
+	// 0-n bytes attributes
+	header := make([]byte, 20)
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	raw := make([]byte, 20+int(binary.BigEndian.Uint16(header[2:4])))
+	copy(raw, header)
+	if _, err = io.ReadFull(conn, raw[20:]); err != nil {
+		return "", err
+	}
+	res := new(stun.Message)
+	if err = stun.Decode(raw, res); err != nil {
+		return "", err
+	}
+	var mappedAddr stun.XORMappedAddress
+	if err = mappedAddr.GetFrom(res); err != nil {
+		return "", fmt.Errorf("failed to get MAPPED-ADDRESS: %s", err)
+	}
+	return mappedAddr.String(), nil
+}
+
+// connectTCP punches a TCP connection to the remote and sets up TLS and a
+// stream multiplexer on it. The greater token acts as TLS and yamux client.
+func (t *Tunnel) connectTCP() error {
+	conn, err := t.tcpPunch(t.ctx)
+	if err != nil {
+		return err
+	}
+	var session *yamux.Session
+	var tlsCfg *tls.Config
+	if t.localNAT.Token > t.remoteNAT.Token {
+		tlsConn := tls.Client(conn, &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         []string{"h2", "tunnel"},
+		})
+		if err = tlsConn.HandshakeContext(t.ctx); err != nil {
+			_ = conn.Close()
+			return err
+		}
+		session, err = yamux.Client(tlsConn, yamuxConfig())
+	} else {
+		tlsCfg, err = generateTLSConfig()
+		if err != nil {
+			_ = conn.Close()
+			return err
+		}
+		tlsConn := tls.Server(conn, tlsCfg)
+		if err = tlsConn.HandshakeContext(t.ctx); err != nil {
+			_ = conn.Close()
+			return err
+		}
+		session, err = yamux.Server(tlsConn, yamuxConfig())
+	}
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	t.tcpSession = session
+	return nil
+}
+
+// tcpPunch dials the remote's mapped TCP address from our STUN port while
+// accepting on it, so the SYNs of both sides cross and open both NATs.
+// Several connections may come up; the client picks the first one and sends
+// its token on it, the server keeps the connection the token arrives on.
+func (t *Tunnel) tcpPunch(ctx context.Context) (net.Conn, error) {
+	log.Debugln("handshake tcp ...")
+	ln := t.tcpListener
+	defer ln.Close()
+	remoteAddr, err := net.ResolveTCPAddr("tcp4", t.remoteNAT.TCPAddr)
+	if err != nil {
+		return nil, err
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ctx, cancel := context.WithTimeout(ctx, tcpPunchTimeout)
+	defer cancel()
+	context.AfterFunc(ctx, func() {
+		_ = ln.Close()
+	})
+
+	conns := make(chan net.Conn)
+	offer := func(c net.Conn) {
+		select {
+		case conns <- c:
+		case <-ctx.Done():
+			_ = c.Close()
+		}
+	}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if !c.RemoteAddr().(*net.TCPAddr).IP.Equal(remoteAddr.IP) {
+				_ = c.Close()
+				continue
+			}
+			offer(c)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for {
+			d := net.Dialer{
+				LocalAddr: &net.TCPAddr{Port: port},
+				Control:   reuseControl,
+				Timeout:   time.Second,
+			}
+			c, err := d.DialContext(ctx, "tcp4", remoteAddr.String())
+			if err == nil {
+				offer(c)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(200 * time.Millisecond):
+			}
+		}
+	}()
+
+	if t.localNAT.Token > t.remoteNAT.Token {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case c := <-conns:
+			if _, err := c.Write([]byte(t.localNAT.Token)); err != nil {
+				_ = c.Close()
+				return nil, err
+			}
+			return c, nil
+		}
+	}
+
+	winner := make(chan net.Conn, 1)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case c := <-winner:
+			return c, nil
+		case c := <-conns:
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				stop := context.AfterFunc(ctx, func() {
+					_ = c.Close()
+				})
+				hello := make([]byte, len(t.remoteNAT.Token))
+				_, err := io.ReadFull(c, hello)
+				if err != nil || string(hello) != t.remoteNAT.Token || !stop() {
+					_ = c.Close()
+					return
+				}
+				select {
+				case winner <- c:
+				default:
+					_ = c.Close()
+				}
+			}()
+		}
+	}
+}
+
+func yamuxConfig() *yamux.Config {
+	cfg := yamux.DefaultConfig()
+	cfg.LogOutput = nil
+	cfg.Logger = log
+	return cfg
+}
+
+// tcpTransport runs streams over the yamux session on the punched TCP connection.
+// TCP has no unreliable delivery, so datagrams are not supported.
+type tcpTransport struct {
+	session *yamux.Session
+}
+
+// OpenStream opens a yamux stream, which waits for a free slot of the accept
+// backlog and the remote's ack; yamux takes no context, so a stream opened
+// after ctx ended is closed again.
+func (t *tcpTransport) OpenStream(ctx context.Context) (net.Conn, error) {
+	type result struct {
+		s   net.Conn
+		err error
+	}
+	opened := make(chan result, 1)
+	go func() {
+		s, err := t.session.OpenStream()
+		if err != nil {
+			opened <- result{nil, err}
+			return
+		}
+		opened <- result{yamuxStream{s}, nil}
+	}()
+	select {
+	case r := <-opened:
+		return r.s, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-opened; r.err == nil {
+				_ = r.s.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+func (t *tcpTransport) AcceptStream(ctx context.Context) (net.Conn, error) {
+	s, err := t.session.AcceptStreamWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return yamuxStream{s}, nil
+}
+
+// yamuxStream lets a yamux stream half-close like the streams of the other
+// transports. yamux's Close already is one: it sends FIN and keeps reading
+// until the remote's FIN.
+type yamuxStream struct {
+	*yamux.Stream
+}
+
+func (s yamuxStream) CloseWrite() error { return s.Stream.Close() }
+
+func (t *tcpTransport) SendDatagram([]byte) error {
+	return ErrDatagramsUnsupported
+}
+
+func (t *tcpTransport) ReceiveDatagram(context.Context) ([]byte, error) {
+	return nil, ErrDatagramsUnsupported
+}
+
+func (t *tcpTransport) MaxDatagramSize() int { return 0 }
+
+func (t *tcpTransport) Close() error         { return t.session.Close() }
+func (t *tcpTransport) LocalAddr() net.Addr  { return t.session.LocalAddr() }
+func (t *tcpTransport) RemoteAddr() net.Addr { return t.session.RemoteAddr() }
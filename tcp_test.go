@@ -0,0 +1,174 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/pion/stun"
+)
+
+// newTCPPair connects two tcpTransports with yamux over loopback TCP, the
+// way connectTCP does on a punched connection.
+func newTCPPair(t *testing.T) (*tcpTransport, *tcpTransport) {
+	t.Helper()
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+	conn, err := net.Dial("tcp4", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, ok := <-accepted
+	if !ok {
+		_ = conn.Close()
+		t.Fatal("accept failed")
+	}
+	cs, err := yamux.Client(conn, yamuxConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss, err := yamux.Server(server, yamuxConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, srv := &tcpTransport{session: cs}, &tcpTransport{session: ss}
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = srv.Close()
+	})
+	return client, srv
+}
+
+// serveTCPStun answers STUN binding requests over TCP on loopback with the
+// address each request came from.
+func serveTCPStun(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				header := make([]byte, 20)
+				if _, err := io.ReadFull(conn, header); err != nil {
+					return
+				}
+				raw := make([]byte, 20+int(binary.BigEndian.Uint16(header[2:4])))
+				copy(raw, header)
+				if _, err := io.ReadFull(conn, raw[20:]); err != nil {
+					return
+				}
+				req := new(stun.Message)
+				if err := stun.Decode(raw, req); err != nil {
+					return
+				}
+				from := conn.RemoteAddr().(*net.TCPAddr)
+				res, err := stun.Build(stun.NewTransactionIDSetter(req.TransactionID), stun.BindingSuccess,
+					&stun.XORMappedAddress{IP: from.IP, Port: from.Port})
+				if err != nil {
+					return
+				}
+				_, _ = conn.Write(res.Raw)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// TestTCPSimultaneousOpen punches two peers over loopback TCP, both dial
+// from their STUN port while accepting on it, and runs yamux on top.
+func TestTCPSimultaneousOpen(t *testing.T) {
+	servers := tcpStunServers
+	tcpStunServers = []string{serveTCPStun(t)}
+	defer func() { tcpStunServers = servers }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	a := &Tunnel{ctx: ctx, localNAT: &NATDetail{Token: tokenA}}
+	b := &Tunnel{ctx: ctx, localNAT: &NATDetail{Token: tokenB}}
+	for _, tunnel := range []*Tunnel{a, b} {
+		addr, err := tunnel.listenTCP()
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := tunnel.tcpListener.Addr().(*net.TCPAddr).Port
+		if want := net.JoinHostPort("127.0.0.1", strconv.Itoa(port)); addr != want {
+			t.Fatalf("mapped addr %s, want %s", addr, want)
+		}
+		tunnel.localNAT.TCPAddr = addr
+	}
+	a.remoteNAT, b.remoteNAT = b.localNAT, a.localNAT
+
+	errs := make(chan error, 2)
+	for _, tunnel := range []*Tunnel{a, b} {
+		go func() { errs <- tunnel.connectTCP() }()
+	}
+	for range 2 {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	ta, tb := &tcpTransport{session: a.tcpSession}, &tcpTransport{session: b.tcpSession}
+	defer ta.Close()
+	defer tb.Close()
+
+	for _, dir := range []struct {
+		name         string
+		open, accept *tcpTransport
+	}{
+		{"a to b", ta, tb},
+		{"b to a", tb, ta},
+	} {
+		go func() {
+			s, err := dir.accept.AcceptStream(ctx)
+			if err != nil {
+				return
+			}
+			defer s.Close()
+			_, _ = io.Copy(s, s)
+		}()
+		s, err := dir.open.OpenStream(ctx)
+		if err != nil {
+			t.Fatalf("%s: %v", dir.name, err)
+		}
+		msg := []byte(dir.name)
+		if _, err = s.Write(msg); err != nil {
+			t.Fatalf("%s: %v", dir.name, err)
+		}
+		got := make([]byte, len(msg))
+		if _, err = io.ReadFull(s, got); err != nil {
+			t.Fatalf("%s: %v", dir.name, err)
+		}
+		_ = s.Close()
+		if string(got) != dir.name {
+			t.Fatalf("%s: echo %q", dir.name, got)
+		}
+	}
+	if err := ta.SendDatagram([]byte("x")); err != ErrDatagramsUnsupported {
+		t.Fatalf("send datagram: %v, want %v", err, ErrDatagramsUnsupported)
+	}
+}
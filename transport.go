@@ -0,0 +1,42 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// ErrDatagramsUnsupported is returned for datagrams on a connection without
+// unreliable delivery, e.g. the TCP fallback.
+var ErrDatagramsUnsupported = errors.New("datagrams not supported by transport")
+
+// transport carries a Peer's streams and datagrams, independent of how the
+// connection to the remote was established: QUIC on a punched UDP socket or
+// through a relay, yamux on a punched TCP connection, or WebRTC data channels.
+type transport interface {
+	// OpenStream opens a bidirectional stream, the remote receives it from AcceptStream.
+	OpenStream(ctx context.Context) (net.Conn, error)
+	AcceptStream(ctx context.Context) (net.Conn, error)
+	// SendDatagram sends an unreliable message, it may be lost or reordered.
+	SendDatagram(b []byte) error
+	ReceiveDatagram(ctx context.Context) ([]byte, error)
+	// MaxDatagramSize is the largest datagram SendDatagram accepts, zero if
+	// datagrams are not supported.
+	MaxDatagramSize() int
+	Close() error
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+}
+
+// connectTransport returns the transport for the path Connect established.
+func (t *Tunnel) connectTransport() (transport, error) {
+	if t.tcpSession != nil {
+		return &tcpTransport{session: t.tcpSession}, nil
+	}
+	qw := upgrade(t)
+	qt, err := qw.quicConnect(t.ctx)
+	if err != nil {
+		return nil, err
+	}
+	return qt, nil
+}
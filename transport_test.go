@@ -0,0 +1,187 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// newPeerPair connects two Peers over an in-memory transport.
+func newPeerPair(t *testing.T) (*Peer, *Peer) {
+	t.Helper()
+	a, b := Pipe()
+	t.Cleanup(func() {
+		_ = a.Close()
+		_ = b.Close()
+	})
+	return a, b
+}
+
+// transportPair connects two transports of one kind, both are closed with
+// the test.
+type transportPair struct {
+	name string
+	pair func(t *testing.T) (transport, transport)
+}
+
+// transportPairs are all kinds of transport a Peer runs on.
+var transportPairs = []transportPair{
+	{"mem", func(t *testing.T) (transport, transport) {
+		a, b := newMemTransportPair()
+		t.Cleanup(func() {
+			_ = a.Close()
+			_ = b.Close()
+		})
+		return a, b
+	}},
+	{"quic", func(t *testing.T) (transport, transport) {
+		a, b := newQuicPair(t)
+		return a, b
+	}},
+	{"tcp", func(t *testing.T) (transport, transport) {
+		a, b := newTCPPair(t)
+		return a, b
+	}},
+	{"webrtc", func(t *testing.T) (transport, transport) {
+		a, b := newWebRTCPair(t)
+		return a, b
+	}},
+}
+
+// peerPair connects two Peers the way the Tunnel sets them up, both are
+// closed with the test.
+type peerPair struct {
+	name string
+	pair func(t *testing.T) (*Peer, *Peer)
+}
+
+// peerPairs run HTTP/2 Peers over every transport, and HTTP/3 over QUIC.
+var peerPairs = func() []peerPair {
+	var pairs []peerPair
+	for _, tp := range transportPairs {
+		pairs = append(pairs, peerPair{tp.name, func(t *testing.T) (*Peer, *Peer) {
+			ta, tb := tp.pair(t)
+			a := newHTTP2Peer(context.Background(), ta)
+			b := newHTTP2Peer(context.Background(), tb)
+			t.Cleanup(func() {
+				_ = a.Close()
+				_ = b.Close()
+			})
+			return a, b
+		}})
+	}
+	return append(pairs, peerPair{"http3", func(t *testing.T) (*Peer, *Peer) {
+		a, b, _, _ := newHTTP3PeerPair(t)
+		return a, b
+	}})
+}()
+
+// TestTransports checks what the Peer relies on from every transport:
+// streams both ways with half-close, datagrams within the reported size or
+// ErrDatagramsUnsupported, and Close ending the remote's accept.
+func TestTransports(t *testing.T) {
+	for _, tp := range transportPairs {
+		t.Run(tp.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			a, b := tp.pair(t)
+
+			for _, dir := range []struct{ open, accept transport }{{a, b}, {b, a}} {
+				go func() {
+					s, err := dir.accept.AcceptStream(ctx)
+					if err != nil {
+						return
+					}
+					defer s.Close()
+					req, _ := io.ReadAll(s)
+					_, _ = s.Write(bytes.ToUpper(req))
+				}()
+				s, err := dir.open.OpenStream(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err = s.Write([]byte("ping")); err != nil {
+					t.Fatal(err)
+				}
+				if cw, ok := s.(closeWriter); ok {
+					if err = cw.CloseWrite(); err != nil {
+						t.Fatal(err)
+					}
+				} else {
+					t.Fatalf("%T can't half-close", s)
+				}
+				resp, err := io.ReadAll(s)
+				_ = s.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(resp) != "PING" {
+					t.Fatalf("response %q", resp)
+				}
+			}
+
+			if a.MaxDatagramSize() == 0 {
+				if err := a.SendDatagram([]byte("ping")); !errors.Is(err, ErrDatagramsUnsupported) {
+					t.Fatalf("send datagram: %v, want %v", err, ErrDatagramsUnsupported)
+				}
+			} else {
+				if err := a.SendDatagram(make([]byte, a.MaxDatagramSize()+1)); err == nil {
+					t.Fatal("sent a datagram over the size limit")
+				}
+				sendCtx, stop := context.WithCancel(ctx)
+				go func() {
+					// unreliable, so send until one arrives
+					for sendCtx.Err() == nil {
+						_ = a.SendDatagram([]byte("ping"))
+						time.Sleep(50 * time.Millisecond)
+					}
+				}()
+				got, err := b.ReceiveDatagram(ctx)
+				stop()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != "ping" {
+					t.Fatalf("datagram %q", got)
+				}
+			}
+
+			if err := a.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := b.AcceptStream(ctx); err == nil || ctx.Err() != nil {
+				t.Fatalf("accept after the remote closed: %v", err)
+			}
+		})
+	}
+}
+
+// TestPeerTransports sends requests both ways between Peers over every
+// transport.
+func TestPeerTransports(t *testing.T) {
+	for _, pp := range peerPairs {
+		t.Run(pp.name, func(t *testing.T) {
+			a, b := pp.pair(t)
+			for _, p := range []*Peer{a, b} {
+				p.HandleFunc("/addr", func(w http.ResponseWriter, r *http.Request) {
+					_, _ = io.WriteString(w, p.tr.LocalAddr().Network())
+				})
+			}
+			for i, p := range []*Peer{a, b} {
+				resp, err := p.Client.Get("https://tunnel/addr")
+				if err != nil {
+					t.Fatalf("peer %d: %s", i, err)
+				}
+				body, _ := io.ReadAll(resp.Body)
+				_ = resp.Body.Close()
+				if want := p.tr.RemoteAddr().Network(); string(body) != want {
+					t.Fatalf("peer %d: served by %q, want %q", i, body, want)
+				}
+			}
+		})
+	}
+}
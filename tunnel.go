@@ -1,13 +1,19 @@
 package tunnel
 
 import (
-	"bufio"
 	"context"
+	"errors"
 	"fmt"
-	"io"
 	"net"
-	"os"
 	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+var (
+	errSymmetricNAT = errors.New("symmetric NAT not supported")
+	errNoUDP        = errors.New("no udp candidates")
+	errPunchExpired = errors.New("all punch sockets expired")
 )
 
 type Tunnel struct {
@@ -17,17 +23,38 @@ type Tunnel struct {
 	remoteAddr net.UDPAddr
 	localNAT   *NATDetail
 	remoteNAT  *NATDetail
+	punchAt    time.Time
+	punchLead  time.Duration
 	signal     Signal
 	cancelFunc context.CancelFunc
+	ttl        TTLStrategy
+	stats      punchStats
+
+	punchConcurrency int
+
+	tcpFallback bool
+	tcpListener net.Listener
+	tcpSession  *yamux.Session
+
+	relayURL  string
+	relayAddr net.Addr
 }
 
-func NewTunnel(ctx context.Context, signal Signal) (*Tunnel, error) {
+// Option configures optional Tunnel behaviour.
+type Option func(*Tunnel)
+
+func NewTunnel(ctx context.Context, signal Signal, opts ...Option) (*Tunnel, error) {
 	ctx, cancelFunc := context.WithCancel(ctx)
-	return &Tunnel{
+	t := &Tunnel{
 		ctx:        ctx,
 		signal:     signal,
 		cancelFunc: cancelFunc,
-	}, nil
+		punchLead:  defaultPunchLead,
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t, nil
 }
 
 func (t *Tunnel) Connect() error {
@@ -35,143 +62,110 @@ func (t *Tunnel) Connect() error {
 	if err != nil {
 		return err
 	}
-	c := handshake(t)
-	err, notClosed := <-c
-	if !notClosed {
-		log.Debugln("tunnel hole punch success")
-		log.Debugf("local addr: %s, remote addr: %s\n", t.localAddr.String(), t.remoteAddr.String())
+	// every way of failing to find a direct path ends up at the relay
+	err = t.connectDirect()
+	if err == nil {
 		return nil
 	}
-	return err
-}
-
-// TODO: temporary code ↓
-func (t *Tunnel) Test(mode string) {
-	if mode == "server" {
-		t.runHandler()
-	} else {
-		go t.keepAlive()
-		for {
-			select {
-			case <-t.ctx.Done():
-				return
-			default:
-				fmt.Printf("Message: ")
-				r := bufio.NewReader(os.Stdin)
-				var in []byte
-				for {
-					var err error
-					in, err = r.ReadBytes('\n')
-					if err != io.EOF {
-						if err != nil {
-							break
-						}
-					}
-					if len(in) > 0 {
-						break
-					}
-				}
-				msg, err := NewDataMessage(t.localNAT.Token, in).Marshal()
-				if err != nil {
-					log.Debugf("marshal message error: %s\n", err)
-					continue
-				}
-				_, err = t.conn.WriteTo(msg, &t.remoteAddr)
-				if err != nil {
-					log.Debugf("send message error: %s\n", err)
-					continue
-				}
-			}
+	if t.relayURL != "" {
+		log.Debugf("%s, falling back to relay\n", err)
+		relayErr := t.connectRelay()
+		if relayErr == nil {
+			return nil
 		}
+		err = fmt.Errorf("%w, relay: %w", err, relayErr)
 	}
+	return err
 }
 
-func (t *Tunnel) runHandler() {
-	bytes := make([]byte, 1024)
-	timeout := time.NewTimer(time.Second * 10)
-	for {
-		select {
-		case <-t.ctx.Done():
-			return
-		case <-timeout.C:
-			t.Close()
-			return
-		default:
-			err := t.conn.SetReadDeadline(time.Now().Add(time.Second * 5))
-			if err != nil {
-				log.Debugf("set read deadline error: %s\n", err)
-				continue
-			}
-			n, addr, err := t.conn.ReadFrom(bytes)
-			if err != nil {
-				log.Debugf("read from conn error: %s\n", err)
-				continue
-			}
-			if addr.String() != t.remoteAddr.String() {
-				log.Debugf("received message from unexpected addr: %s\n", addr.String())
-				continue
-			}
-			msg, err := UnmarshalMessage(bytes[:n])
-			if err != nil {
-				log.Debugf("unmarshal message error: %s\n", err)
-				continue
-			}
-			if msg.token != t.remoteNAT.Token {
-				log.Debugf("received message with unexpected token: %s\n", msg.token)
-				continue
-			}
-			switch msg.mType {
-			case MessageTypeHandshake:
-				log.Debugf("received handshake message from %s\n", addr.String())
-			case MessageTypePing:
-				if !timeout.Stop() {
-					<-timeout.C
-				}
-				timeout.Reset(time.Second * 10)
-			case MessageTypeData:
-				log.Debugf("received data message from %s, payload: %s\n", addr.String(), string(msg.payload))
-			}
+// connectDirect punches through both NATs over UDP, or over TCP when UDP
+// punching failed or either side has no UDP candidates.
+func (t *Tunnel) connectDirect() error {
+	err := t.punchUDP()
+	if err == nil {
+		if t.tcpListener != nil {
+			_ = t.tcpListener.Close()
 		}
+		return nil
+	}
+	if t.tcpListener == nil {
+		return err
+	}
+	if t.remoteNAT.TCPAddr == "" || errors.Is(err, errSymmetricNAT) {
+		_ = t.tcpListener.Close()
+		return err
+	}
+	log.Debugf("%s, falling back to tcp\n", err)
+	if tcpErr := t.connectTCP(); tcpErr != nil {
+		return fmt.Errorf("%w, tcp: %w", err, tcpErr)
 	}
+	log.Debugln("tunnel tcp hole punch success")
+	return nil
 }
 
-func (t *Tunnel) keepAlive() {
-	// send and wait receive ping message
-	pingMsg, err := NewPingMessage(t.localNAT.Token).Marshal()
-	if err != nil {
-		return
+func (t *Tunnel) punchUDP() error {
+	if t.localNAT.Addr == "" || t.remoteNAT.Addr == "" {
+		return errNoUDP
 	}
-	tick := time.NewTicker(time.Second)
-	for {
-		select {
-		case <-t.ctx.Done():
-			return
-		case <-tick.C:
-			_, _ = t.conn.WriteTo(pingMsg, &t.remoteAddr)
-		}
+	// if both NATs are symmetric, we can't do anything
+	if t.remoteNAT.NATType == NATTypeSymmetric && t.localNAT.NATType == NATTypeSymmetric {
+		return errSymmetricNAT
 	}
+	c := handshake(t)
+	err, notClosed := <-c
+	if notClosed {
+		return fmt.Errorf("udp %w", err)
+	}
+	log.Debugln("tunnel hole punch success")
+	log.Debugf("local addr: %s, remote addr: %s\n", t.localAddr.String(), t.remoteAddr.String())
+	// hand QUIC a socket that can follow local network changes
+	conn := newMigratingConn(t.conn.(*net.UDPConn), t.remoteAddr, t.localNAT.Token, t.remoteNAT.Token)
+	t.conn = conn
+	go t.watchNetwork(conn)
+	return nil
 }
 
-// TODO: temporary code ↑
-
 func (t *Tunnel) initTunnel() error {
-	conn, err := net.ListenPacket("udp4", "0.0.0.0:0")
-	if err != nil {
-		return err
-	}
-	defer func() {
-		_ = conn.Close()
-	}()
-	resolver, err := NewResolver(conn)
-	if err != nil {
-		return err
+	// propose a common start so both sides punch at the same time,
+	// regardless of when each one reads the other's signal; the clock
+	// offset is estimated while the NAT is resolved
+	var offsets chan time.Duration
+	if t.punchLead > 0 {
+		offsets = make(chan time.Duration, 1)
+		go func() {
+			offset, err := clockOffset()
+			if err != nil {
+				log.Debugf("estimate clock offset error: %s\n", err)
+			}
+			offsets <- offset
+		}()
 	}
-	defer resolver.Close()
-	localNAT, err := resolver.Resolve()
+	localNAT, port, err := resolveNAT()
 	if err != nil {
-		return err
+		// e.g. on a network dropping UDP, still signal so TCP or the relay
+		// can be tried; an empty Addr tells the remote there is nothing to
+		// punch over UDP
+		log.Debugf("resolve nat error: %s, no udp candidates\n", err)
+		token, err := GenerateToken()
+		if err != nil {
+			return err
+		}
+		localNAT = &NATDetail{Token: token}
 	}
 	t.localNAT = localNAT
+	if t.tcpFallback {
+		tcpAddr, err := t.listenTCP()
+		if err != nil {
+			log.Debugf("tcp fallback unavailable: %s\n", err)
+		}
+		localNAT.TCPAddr = tcpAddr
+	}
+	// without UDP candidates there is nothing to punch together
+	var offset time.Duration
+	if offsets != nil && localNAT.Addr != "" {
+		offset = <-offsets
+		localNAT.PunchAt = time.Now().Add(offset).Add(t.punchLead).UnixMilli()
+	}
 	err = t.signal.SendSignal(localNAT)
 	if err != nil {
 		return err
@@ -181,21 +175,48 @@ func (t *Tunnel) initTunnel() error {
 		return err
 	}
 	log.Debugf("remote nat type: %d, token: %s, addr: %s\n", remoteNAT.NATType, remoteNAT.Token, remoteNAT.Addr)
-	// if both NATs are symmetric, we can't do anything
-	if remoteNAT.NATType == NATTypeSymmetric && localNAT.NATType == NATTypeSymmetric {
-		return fmt.Errorf("symmetric NAT not supported")
-	}
 	t.localNAT = localNAT
 	t.remoteNAT = remoteNAT
+	t.punchAt = punchStart(localNAT.PunchAt, remoteNAT.PunchAt, offset, time.Now())
 	t.localAddr = net.UDPAddr{
 		IP:   net.IPv4zero,
-		Port: conn.LocalAddr().(*net.UDPAddr).Port,
+		Port: port,
 	}
 	return nil
 }
 
+// resolveNAT detects the NAT in front of a fresh UDP socket and returns it
+// with the socket's port, hole punching binds that port again.
+func resolveNAT() (*NATDetail, int, error) {
+	conn, err := net.ListenPacket("udp4", "0.0.0.0:0")
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	resolver, err := NewResolver(conn)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resolver.Close()
+	localNAT, err := resolver.Resolve()
+	if err != nil {
+		return nil, 0, err
+	}
+	return localNAT, conn.LocalAddr().(*net.UDPAddr).Port, nil
+}
+
 func (t *Tunnel) Close() {
 	t.cancelFunc()
+	if t.tcpSession != nil {
+		if err := t.tcpSession.Close(); err != nil {
+			log.Debugf("close tunnel error: %s\n", err)
+		}
+	}
+	if t.conn == nil {
+		return
+	}
 	err := t.conn.Close()
 	if err != nil {
 		log.Debugf("close tunnel error: %s\n", err)
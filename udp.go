@@ -0,0 +1,340 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go/quicvarint"
+)
+
+// udpProtocol is the protocol of the control stream of a forwarded UDP flow.
+// The opening side sends the kind of flow, the target or the id of the
+// reverse listener, and the id it receives the flow's datagrams with; the
+// remote answers with a status byte and its own id:
+//
+//	1 byte  kind, udpFlowTarget or udpFlowReverse
+//	1 byte  target or listener id length
+//	n bytes target, host:port, or listener id
+//	varint  id of the opening side
+//
+//	1 byte  status
+//	varint  id of the remote
+//
+// Packets travel as datagrams starting with the receiver's id. Packets too
+// large for a datagram, or all of them without datagram support, are sent on
+// the control stream:
+//
+//	2 bytes packet length
+//	n bytes packet
+const udpProtocol = reservedPrefix + "udp"
+
+const (
+	udpFlowTarget byte = iota
+	udpFlowReverse
+)
+
+// udpIdleTimeout ends a flow without packets in either direction, like a NAT
+// drops an idle UDP mapping.
+const udpIdleTimeout = time.Minute * 2
+
+// udpQueueSize is how many packets of a client may wait for its flow.
+const udpQueueSize = 64
+
+const maxUDPPacket = 65535
+
+// udpFlow is one forwarded UDP flow, a local client address on one side and
+// a socket connected to the target on the other.
+type udpFlow struct {
+	p        *Peer
+	s        *Stream
+	id       uint64
+	remoteID uint64
+	// deliver passes a packet from the remote to the local side of the flow.
+	deliver func([]byte)
+	// onClose releases the local side of the flow.
+	onClose func()
+	last    atomic.Int64
+	idle    *time.Timer
+	writeMu sync.Mutex
+	done    chan struct{}
+	once    sync.Once
+}
+
+// ForwardUDP listens on listenAddr and forwards the packets of every local
+// client as a flow to the remote, which sends them to remoteTarget from its
+// own socket per flow, and delivers the replies back to the client. The
+// remote has to allow the target with AllowForward. Closing the returned
+// conn stops forwarding and ends all flows.
+func (p *Peer) ForwardUDP(listenAddr, remoteTarget string) (net.PacketConn, error) {
+	pc, err := net.ListenPacket("udp", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	go p.serveUDPListener(pc, func(ctx context.Context, deliver func([]byte)) (*udpFlow, error) {
+		return p.openUDPFlow(ctx, udpFlowTarget, remoteTarget, deliver)
+	})
+	return pc, nil
+}
+
+// ForwardUDPRemote makes the remote listen on remoteListenAddr and forward the
+// packets of every client as a flow back to us, where they are sent to
+// localTarget. The remote has to allow the address with AllowListen.
+func (p *Peer) ForwardUDPRemote(remoteListenAddr, localTarget string) (*RemoteForward, error) {
+	return p.forwardRemote("udp", remoteListenAddr, localTarget)
+}
+
+func (p *Peer) newUDPFlow(s *Stream, deliver func([]byte)) *udpFlow {
+	f := &udpFlow{
+		p:       p,
+		s:       s,
+		id:      p.flowID.Add(1),
+		deliver: deliver,
+		done:    make(chan struct{}),
+	}
+	f.last.Store(time.Now().UnixNano())
+	f.idle = time.AfterFunc(udpIdleTimeout, f.expire)
+	p.flowMu.Lock()
+	p.flows[f.id] = f
+	p.flowMu.Unlock()
+	return f
+}
+
+func (p *Peer) flow(id uint64) *udpFlow {
+	p.flowMu.Lock()
+	defer p.flowMu.Unlock()
+	return p.flows[id]
+}
+
+// openUDPFlow opens a flow to target, or to the local target of the reverse
+// listener with that id.
+func (p *Peer) openUDPFlow(ctx context.Context, kind byte, target string, deliver func([]byte)) (*udpFlow, error) {
+	s, err := p.openStream(ctx, udpProtocol)
+	if err != nil {
+		return nil, err
+	}
+	f := p.newUDPFlow(s, deliver)
+	stop := context.AfterFunc(ctx, func() {
+		_ = s.Close()
+	})
+	f.remoteID, err = requestUDPFlow(s, kind, target, f.id)
+	if !stop() {
+		err = ctx.Err()
+	}
+	if err != nil {
+		f.close()
+		return nil, err
+	}
+	go f.run()
+	return f, nil
+}
+
+func requestUDPFlow(s *Stream, kind byte, target string, id uint64) (uint64, error) {
+	req := appendString([]byte{kind}, target)
+	if _, err := s.Write(quicvarint.Append(req, id)); err != nil {
+		return 0, err
+	}
+	status := make([]byte, 1)
+	if _, err := io.ReadFull(s, status); err != nil {
+		return 0, err
+	}
+	if err := forwardError(status[0]); err != nil {
+		return 0, err
+	}
+	return quicvarint.Read(quicvarint.NewReader(s))
+}
+
+// serveUDP sends the packets of a flow the remote opened to its target, from
+// a socket of its own, and the target's replies back.
+func (p *Peer) serveUDP(s *Stream) {
+	_ = s.SetReadDeadline(time.Now().Add(streamHeaderTimeout))
+	kind := make([]byte, 1)
+	_, err := io.ReadFull(s, kind)
+	var target string
+	if err == nil {
+		target, err = readString(s)
+	}
+	var remoteID uint64
+	if err == nil {
+		remoteID, err = quicvarint.Read(quicvarint.NewReader(s))
+	}
+	if err != nil {
+		log.Debugf("read udp flow request error: %s\n", err)
+		_ = s.Close()
+		return
+	}
+	_ = s.SetReadDeadline(time.Time{})
+
+	allowed := false
+	switch kind[0] {
+	case udpFlowTarget:
+		allowed = p.forwardAllowed(target)
+	case udpFlowReverse:
+		p.forwardMu.RLock()
+		target, allowed = p.reverseTargets[target]
+		p.forwardMu.RUnlock()
+	}
+	if !allowed {
+		log.Debugf("udp flow to %s denied\n", target)
+		_, _ = s.Write([]byte{forwardDenied})
+		_ = s.Close()
+		return
+	}
+	conn, err := net.Dial("udp", target)
+	if err != nil {
+		log.Debugf("udp flow dial %s error: %s\n", target, err)
+		_, _ = s.Write([]byte{forwardDialFailed})
+		_ = s.Close()
+		return
+	}
+	f := p.newUDPFlow(s, func(b []byte) {
+		_, _ = conn.Write(b)
+	})
+	f.remoteID = remoteID
+	f.onClose = func() {
+		_ = conn.Close()
+	}
+	if _, err = s.Write(quicvarint.Append([]byte{forwardOK}, f.id)); err != nil {
+		f.close()
+		return
+	}
+	go f.run()
+	buf := make([]byte, maxUDPPacket)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			f.close()
+			return
+		}
+		f.send(buf[:n])
+	}
+}
+
+// serveUDPListener opens a flow for every client sending to pc and forwards
+// the client's packets on it, until pc is closed.
+func (p *Peer) serveUDPListener(pc net.PacketConn, open func(context.Context, func([]byte)) (*udpFlow, error)) {
+	done := make(chan struct{})
+	defer close(done)
+	defer pc.Close()
+	var mu sync.Mutex
+	clients := map[string]chan []byte{}
+	buf := make([]byte, maxUDPPacket)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		key := addr.String()
+		mu.Lock()
+		out, ok := clients[key]
+		if !ok {
+			out = make(chan []byte, udpQueueSize)
+			clients[key] = out
+			go func() {
+				p.serveUDPClient(out, done, open, func(b []byte) {
+					_, _ = pc.WriteTo(b, addr)
+				})
+				mu.Lock()
+				delete(clients, key)
+				mu.Unlock()
+			}()
+		}
+		mu.Unlock()
+		select {
+		case out <- append([]byte(nil), buf[:n]...):
+		default:
+			// flow too slow, drop the packet
+		}
+	}
+}
+
+// serveUDPClient opens a flow and forwards the packets queued in out on it
+// until the flow ends or done is closed. deliver passes the replies on.
+func (p *Peer) serveUDPClient(out chan []byte, done chan struct{}, open func(context.Context, func([]byte)) (*udpFlow, error), deliver func([]byte)) {
+	ctx, cancel := context.WithTimeout(context.Background(), forwardTimeout)
+	f, err := open(ctx, deliver)
+	cancel()
+	if err != nil {
+		log.Debugf("open udp flow error: %s\n", err)
+		return
+	}
+	defer f.close()
+	for {
+		select {
+		case b := <-out:
+			f.send(b)
+		case <-f.done:
+			return
+		case <-done:
+			return
+		}
+	}
+}
+
+// run delivers the packets arriving on the control stream and ends the flow
+// once it is idle or the stream closes.
+func (f *udpFlow) run() {
+	defer f.close()
+	hdr := make([]byte, 2)
+	buf := make([]byte, maxUDPPacket)
+	for {
+		if _, err := io.ReadFull(f.s, hdr); err != nil {
+			return
+		}
+		b := buf[:binary.BigEndian.Uint16(hdr)]
+		if _, err := io.ReadFull(f.s, b); err != nil {
+			return
+		}
+		f.receive(b)
+	}
+}
+
+func (f *udpFlow) expire() {
+	idle := time.Since(time.Unix(0, f.last.Load()))
+	if idle >= udpIdleTimeout {
+		log.Debugf("udp flow %d idle, closing\n", f.id)
+		f.close()
+		return
+	}
+	f.idle.Reset(udpIdleTimeout - idle)
+}
+
+func (f *udpFlow) receive(b []byte) {
+	f.last.Store(time.Now().UnixNano())
+	f.deliver(b)
+}
+
+// send forwards a packet to the remote, as a datagram if it fits.
+func (f *udpFlow) send(b []byte) {
+	f.last.Store(time.Now().UnixNano())
+	dg := quicvarint.Append(nil, f.remoteID)
+	if len(dg)+len(b) <= f.p.tr.MaxDatagramSize() {
+		if err := f.p.tr.SendDatagram(append(dg, b...)); err == nil {
+			return
+		}
+	}
+	frame := binary.BigEndian.AppendUint16(nil, uint16(len(b)))
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+	if _, err := f.s.Write(append(frame, b...)); err != nil {
+		f.close()
+	}
+}
+
+func (f *udpFlow) close() {
+	f.once.Do(func() {
+		f.p.flowMu.Lock()
+		delete(f.p.flows, f.id)
+		f.p.flowMu.Unlock()
+		f.idle.Stop()
+		_ = f.s.Close()
+		close(f.done)
+		if f.onClose != nil {
+			f.onClose()
+		}
+	})
+}
@@ -0,0 +1,100 @@
+package tunnel
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// listenUDPEcho runs a UDP server answering every packet with the packet
+// prefixed by the address it came from.
+func listenUDPEcho(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+	go func() {
+		buf := make([]byte, maxUDPPacket)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = pc.WriteTo(append([]byte(addr.String()+" "), buf[:n]...), addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+// udpExchange sends packet through conn until the echo answers and returns
+// the address the echo saw, packets may get lost on the way.
+func udpExchange(t *testing.T, conn net.Conn, packet []byte) string {
+	t.Helper()
+	buf := make([]byte, maxUDPPacket)
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := conn.Write(packet); err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, err := conn.Read(buf)
+		if err != nil {
+			continue
+		}
+		from, got, ok := bytes.Cut(buf[:n], []byte(" "))
+		if !ok || !bytes.Equal(got, packet) {
+			t.Fatalf("reply of %d bytes to a packet of %d", n, len(packet))
+		}
+		return string(from)
+	}
+	t.Fatalf("no reply to a packet of %d bytes", len(packet))
+	return ""
+}
+
+func TestForwardUDP(t *testing.T) {
+	for _, pp := range peerPairs {
+		t.Run(pp.name, func(t *testing.T) {
+			a, b := pp.pair(t)
+			echo := listenUDPEcho(t)
+			b.AllowForward(echo)
+			b.AllowListen("127.0.0.1:*")
+
+			local, err := a.ForwardUDP("127.0.0.1:0", echo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer local.Close()
+			remote, err := a.ForwardUDPRemote("127.0.0.1:0", echo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer remote.Close()
+
+			for _, addr := range []string{local.LocalAddr().String(), remote.Addr()} {
+				// every client is a flow of its own, with its own socket
+				// towards the target
+				seen := map[string]bool{}
+				for i := range 2 {
+					conn, err := net.Dial("udp", addr)
+					if err != nil {
+						t.Fatal(err)
+					}
+					defer conn.Close()
+					from := udpExchange(t, conn, []byte(fmt.Sprintf("client %d", i)))
+					// larger than any datagram, it goes over the stream
+					if big := udpExchange(t, conn, bytes.Repeat([]byte{byte(i)}, 8000)); big != from {
+						t.Fatalf("flow moved from %s to %s", from, big)
+					}
+					seen[from] = true
+				}
+				if len(seen) != 2 {
+					t.Fatalf("clients share a flow: %v", seen)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,633 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pion/datachannel"
+	"github.com/pion/webrtc/v3"
+)
+
+// Data channel layout of ConnectWebRTC, a browser peer has to follow it:
+//
+//   - every stream is a reliable, ordered data channel labeled "stream",
+//     opened by either side and carrying raw bytes in binary messages; an
+//     empty message ends the direction it is sent in, like a TCP FIN
+//   - datagrams travel on one negotiated, unordered channel without
+//     retransmits, labeled "datagram" with id 0, created by both sides
+const (
+	streamLabel   = "stream"
+	datagramLabel = "datagram"
+	datagramID    = uint16(0)
+)
+
+// dataChannelChunk is the largest message written to a data channel,
+// every browser accepts messages of this size.
+const dataChannelChunk = 16 * 1024
+
+// webrtcMaxDatagramSize keeps a datagram in a single SCTP packet: pion/sctp
+// sends packets of at most 1228 bytes (its initialMTU), minus the 12 bytes
+// common header and the 16 bytes DATA chunk header.
+const webrtcMaxDatagramSize = 1228 - 12 - 16
+
+// dataChannelMaxMessage is the largest message read from a data channel.
+const dataChannelMaxMessage = 64 * 1024
+
+// dataChannelBuffered is how many bytes may wait in a data channel's send
+// buffer before writes block.
+const dataChannelBuffered = 1024 * 1024
+
+// signalPollInterval spaces repeated reads of the signal while waiting for
+// the answer, for signals that return the last value instead of blocking.
+const signalPollInterval = 500 * time.Millisecond
+
+var errWebRTCFailed = errors.New("webrtc connection failed")
+
+// ConnectWebRTC negotiates a WebRTC PeerConnection, carrying the SDP offer and
+// answer over the Signal, and runs HTTP/2 over its data channels. It replaces
+// Connect for peers that have to talk to browsers; ICE does the NAT traversal.
+//
+// Both sides send an offer first. The side with the greater token keeps its
+// offer and waits for the answer, the other side drops its own and answers.
+func (t *Tunnel) ConnectWebRTC() (*Peer, error) {
+	ctx, cancel := context.WithTimeout(t.ctx, timeout)
+	defer cancel()
+	token, err := GenerateToken()
+	if err != nil {
+		return nil, err
+	}
+	t.localNAT = &NATDetail{Token: token}
+
+	tr, err := newWebRTCTransport(webrtcConfig())
+	if err != nil {
+		return nil, err
+	}
+	offer, err := tr.offer(ctx)
+	if err != nil {
+		_ = tr.Close()
+		return nil, err
+	}
+	t.localNAT.SDP = offer.SDP
+	t.localNAT.SDPType = offer.Type.String()
+	if err = t.signal.SendSignal(t.localNAT); err != nil {
+		_ = tr.Close()
+		return nil, err
+	}
+	remoteNAT, err := t.signal.ReadSignal()
+	if err != nil {
+		_ = tr.Close()
+		return nil, err
+	}
+	t.remoteNAT = remoteNAT
+	if remoteNAT.SDPType != webrtc.SDPTypeOffer.String() {
+		_ = tr.Close()
+		return nil, fmt.Errorf("expected webrtc offer, got %q", remoteNAT.SDPType)
+	}
+
+	if token > remoteNAT.Token {
+		err = t.awaitAnswer(ctx, tr)
+	} else {
+		// a fresh connection, ours already holds our own offer
+		_ = tr.Close()
+		tr, err = newWebRTCTransport(webrtcConfig())
+		if err == nil {
+			err = t.answer(ctx, tr)
+		}
+	}
+	if err == nil {
+		err = tr.waitConnected(ctx)
+	}
+	if err != nil {
+		if tr != nil {
+			_ = tr.Close()
+		}
+		return nil, err
+	}
+	log.Debugf("webrtc connected, local addr: %s, remote addr: %s\n", tr.LocalAddr(), tr.RemoteAddr())
+
+	return newHTTP2Peer(t.ctx, tr), nil
+}
+
+// awaitAnswer reads the signal until the remote's answer arrives and applies it.
+func (t *Tunnel) awaitAnswer(ctx context.Context, tr *webrtcTransport) error {
+	for {
+		remoteNAT, err := t.signal.ReadSignal()
+		if err != nil {
+			return err
+		}
+		if remoteNAT.Token == t.remoteNAT.Token && remoteNAT.SDPType == webrtc.SDPTypeAnswer.String() {
+			return tr.pc.SetRemoteDescription(webrtc.SessionDescription{
+				Type: webrtc.SDPTypeAnswer,
+				SDP:  remoteNAT.SDP,
+			})
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(signalPollInterval):
+		}
+	}
+}
+
+// answer answers the remote's offer and sends the answer over the signal.
+func (t *Tunnel) answer(ctx context.Context, tr *webrtcTransport) error {
+	err := tr.pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  t.remoteNAT.SDP,
+	})
+	if err != nil {
+		return err
+	}
+	answer, err := tr.pc.CreateAnswer(nil)
+	if err != nil {
+		return err
+	}
+	desc, err := tr.setLocalDescription(ctx, answer)
+	if err != nil {
+		return err
+	}
+	return t.signal.SendSignal(&NATDetail{
+		Token:   t.localNAT.Token,
+		SDP:     desc.SDP,
+		SDPType: desc.Type.String(),
+	})
+}
+
+// webrtcTransport runs streams over data channels and datagrams over an
+// unreliable data channel of a PeerConnection.
+type webrtcTransport struct {
+	pc        *webrtc.PeerConnection
+	datagram  *webrtc.DataChannel
+	streams   chan net.Conn
+	datagrams chan []byte
+	connected chan struct{}
+	done      chan struct{}
+	once      sync.Once
+
+	mu         sync.Mutex
+	dgConn     datachannel.ReadWriteCloser
+	localAddr  net.Addr
+	remoteAddr net.Addr
+}
+
+// webrtcAddr stands in for an address before ICE selected a candidate pair.
+type webrtcAddr string
+
+func (a webrtcAddr) Network() string { return "webrtc" }
+func (a webrtcAddr) String() string  { return string(a) }
+
+// webrtcConfig has ICE use the STUN servers of hole punching.
+func webrtcConfig() webrtc.Configuration {
+	var urls []string
+	for _, server := range stunServers[:2] {
+		urls = append(urls, "stun:"+server.stun)
+	}
+	return webrtc.Configuration{
+		ICEServers: []webrtc.ICEServer{{URLs: urls}},
+	}
+}
+
+func newWebRTCTransport(cfg webrtc.Configuration) (*webrtcTransport, error) {
+	var s webrtc.SettingEngine
+	s.DetachDataChannels()
+	api := webrtc.NewAPI(webrtc.WithSettingEngine(s))
+	pc, err := api.NewPeerConnection(cfg)
+	if err != nil {
+		return nil, err
+	}
+	t := &webrtcTransport{
+		pc:         pc,
+		streams:    make(chan net.Conn, 16),
+		datagrams:  make(chan []byte, 64),
+		connected:  make(chan struct{}),
+		done:       make(chan struct{}),
+		localAddr:  webrtcAddr("local"),
+		remoteAddr: webrtcAddr("remote"),
+	}
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		log.Debugf("webrtc connection state: %s\n", state)
+		switch state {
+		case webrtc.PeerConnectionStateConnected:
+			t.setAddrs()
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			_ = t.Close()
+		}
+	})
+	pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+		if dc.Label() != streamLabel {
+			_ = dc.Close()
+			return
+		}
+		dc.OnOpen(func() {
+			conn, err := t.detach(dc)
+			if err != nil {
+				log.Debugf("detach data channel error: %s\n", err)
+				return
+			}
+			select {
+			case t.streams <- conn:
+			case <-t.done:
+				_ = conn.Close()
+			}
+		})
+	})
+
+	ordered := false
+	maxRetransmits := uint16(0)
+	negotiated := true
+	id := datagramID
+	dc, err := pc.CreateDataChannel(datagramLabel, &webrtc.DataChannelInit{
+		Ordered:        &ordered,
+		MaxRetransmits: &maxRetransmits,
+		Negotiated:     &negotiated,
+		ID:             &id,
+	})
+	if err != nil {
+		_ = pc.Close()
+		return nil, err
+	}
+	t.datagram = dc
+	dc.OnOpen(func() {
+		rwc, err := dc.Detach()
+		if err != nil {
+			log.Debugf("detach datagram channel error: %s\n", err)
+			return
+		}
+		t.mu.Lock()
+		t.dgConn = rwc
+		t.mu.Unlock()
+		close(t.connected)
+		go t.readDatagrams(rwc)
+	})
+	return t, nil
+}
+
+// offer creates the local offer, it contains all ICE candidates.
+func (t *webrtcTransport) offer(ctx context.Context) (*webrtc.SessionDescription, error) {
+	offer, err := t.pc.CreateOffer(nil)
+	if err != nil {
+		return nil, err
+	}
+	return t.setLocalDescription(ctx, offer)
+}
+
+// setLocalDescription applies desc and waits for ICE gathering, the signal
+// carries a single description so there is no trickle ICE.
+func (t *webrtcTransport) setLocalDescription(ctx context.Context, desc webrtc.SessionDescription) (*webrtc.SessionDescription, error) {
+	gathered := webrtc.GatheringCompletePromise(t.pc)
+	if err := t.pc.SetLocalDescription(desc); err != nil {
+		return nil, err
+	}
+	select {
+	case <-gathered:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return t.pc.LocalDescription(), nil
+}
+
+// waitConnected waits for the datagram channel to open, which needs ICE,
+// DTLS and SCTP to be up.
+func (t *webrtcTransport) waitConnected(ctx context.Context) error {
+	select {
+	case <-t.connected:
+		return nil
+	case <-t.done:
+		return errWebRTCFailed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// setAddrs takes the addresses of the candidate pair ICE selected.
+func (t *webrtcTransport) setAddrs() {
+	pair, err := t.pc.SCTP().Transport().ICETransport().GetSelectedCandidatePair()
+	if err != nil || pair == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.localAddr = &net.UDPAddr{IP: net.ParseIP(pair.Local.Address), Port: int(pair.Local.Port)}
+	t.remoteAddr = &net.UDPAddr{IP: net.ParseIP(pair.Remote.Address), Port: int(pair.Remote.Port)}
+}
+
+func (t *webrtcTransport) detach(dc *webrtc.DataChannel) (net.Conn, error) {
+	rwc, err := dc.Detach()
+	if err != nil {
+		return nil, err
+	}
+	return newDataChannelConn(dc, rwc, t.LocalAddr(), t.RemoteAddr()), nil
+}
+
+func (t *webrtcTransport) readDatagrams(rwc datachannel.ReadWriteCloser) {
+	buf := make([]byte, dataChannelMaxMessage)
+	for {
+		n, err := rwc.Read(buf)
+		if err != nil {
+			// the SCTP association is gone, e.g. the remote closed; ICE
+			// would only notice once its consent expired
+			_ = t.Close()
+			return
+		}
+		select {
+		case t.datagrams <- append([]byte(nil), buf[:n]...):
+		default:
+			// reader too slow, drop the datagram
+		}
+	}
+}
+
+func (t *webrtcTransport) OpenStream(ctx context.Context) (net.Conn, error) {
+	dc, err := t.pc.CreateDataChannel(streamLabel, nil)
+	if err != nil {
+		return nil, err
+	}
+	opened := make(chan struct{})
+	dc.OnOpen(func() {
+		close(opened)
+	})
+	select {
+	case <-opened:
+		return t.detach(dc)
+	case <-ctx.Done():
+		_ = dc.Close()
+		return nil, ctx.Err()
+	case <-t.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (t *webrtcTransport) AcceptStream(ctx context.Context) (net.Conn, error) {
+	select {
+	case conn := <-t.streams:
+		return conn, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-t.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (t *webrtcTransport) SendDatagram(b []byte) error {
+	if len(b) > webrtcMaxDatagramSize {
+		return errDatagramTooLarge(len(b), webrtcMaxDatagramSize)
+	}
+	t.mu.Lock()
+	rwc := t.dgConn
+	t.mu.Unlock()
+	if rwc == nil {
+		return errWebRTCFailed
+	}
+	_, err := rwc.Write(b)
+	return err
+}
+
+func (t *webrtcTransport) ReceiveDatagram(ctx context.Context) ([]byte, error) {
+	select {
+	case b := <-t.datagrams:
+		return b, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-t.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// MaxDatagramSize keeps datagrams in a single SCTP packet, a larger message
+// is fragmented and lost as a whole when any fragment is.
+func (t *webrtcTransport) MaxDatagramSize() int { return webrtcMaxDatagramSize }
+
+func (t *webrtcTransport) Close() error {
+	var err error
+	t.once.Do(func() {
+		close(t.done)
+		err = t.pc.Close()
+	})
+	return err
+}
+
+func (t *webrtcTransport) LocalAddr() net.Addr {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.localAddr
+}
+
+func (t *webrtcTransport) RemoteAddr() net.Addr {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.remoteAddr
+}
+
+// dataChannelConn is a net.Conn over a detached data channel. Data channels
+// are message based: writes are split into chunks, reads drain one message
+// at a time. CloseWrite sends an empty message, which reads as io.EOF.
+//
+// Read deadlines are kept here rather than on the SCTP stream, whose
+// deadline timer can still fire after the deadline was cleared; net/http
+// does exactly that when h2c takes a connection over.
+type dataChannelConn struct {
+	dc         *webrtc.DataChannel
+	rwc        datachannel.ReadWriteCloser
+	localAddr  net.Addr
+	remoteAddr net.Addr
+
+	// messages are read ahead by readLoop, one at a time
+	messages chan []byte
+	readErr  error
+
+	readMu  sync.Mutex
+	pending []byte
+	eof     bool
+
+	deadlineMu   sync.Mutex
+	readDeadline time.Time
+	deadlineSet  chan struct{}
+
+	writeMu     sync.Mutex
+	writeClosed bool
+	drained     chan struct{}
+	closed      chan struct{}
+	closeOnce   sync.Once
+}
+
+func newDataChannelConn(dc *webrtc.DataChannel, rwc datachannel.ReadWriteCloser, localAddr, remoteAddr net.Addr) *dataChannelConn {
+	c := &dataChannelConn{
+		dc:          dc,
+		rwc:         rwc,
+		localAddr:   localAddr,
+		remoteAddr:  remoteAddr,
+		messages:    make(chan []byte),
+		deadlineSet: make(chan struct{}),
+		drained:     make(chan struct{}, 1),
+		closed:      make(chan struct{}),
+	}
+	dc.SetBufferedAmountLowThreshold(dataChannelBuffered / 2)
+	dc.OnBufferedAmountLow(func() {
+		select {
+		case c.drained <- struct{}{}:
+		default:
+		}
+	})
+	go c.readLoop()
+	return c
+}
+
+func (c *dataChannelConn) readLoop() {
+	defer close(c.messages)
+	buf := make([]byte, dataChannelMaxMessage)
+	for {
+		n, err := c.rwc.Read(buf)
+		if err != nil {
+			c.readErr = err
+			return
+		}
+		select {
+		case c.messages <- append([]byte{}, buf[:n]...):
+		case <-c.closed:
+			c.readErr = net.ErrClosed
+			return
+		}
+	}
+}
+
+func (c *dataChannelConn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	if c.eof {
+		return 0, io.EOF
+	}
+	if len(c.pending) == 0 {
+		msg, err := c.next()
+		if err != nil {
+			return 0, err
+		}
+		if len(msg) == 0 {
+			// the remote closed its side, see CloseWrite
+			c.eof = true
+			return 0, io.EOF
+		}
+		c.pending = msg
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// next returns the next message, waiting for it until the read deadline.
+func (c *dataChannelConn) next() ([]byte, error) {
+	for {
+		c.deadlineMu.Lock()
+		deadline := c.readDeadline
+		deadlineSet := c.deadlineSet
+		c.deadlineMu.Unlock()
+
+		var timer *time.Timer
+		var expired <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return nil, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(d)
+			expired = timer.C
+		}
+		select {
+		case msg, ok := <-c.messages:
+			stopTimer(timer)
+			if !ok {
+				return nil, c.readErr
+			}
+			return msg, nil
+		case <-expired:
+			return nil, os.ErrDeadlineExceeded
+		case <-deadlineSet:
+			// deadline changed, start over
+			stopTimer(timer)
+		}
+	}
+}
+
+func (c *dataChannelConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.writeClosed {
+		return 0, io.ErrClosedPipe
+	}
+	written := 0
+	for len(b) > 0 {
+		// wait for the send buffer to drain instead of growing it without bound
+		for c.dc.BufferedAmount() > dataChannelBuffered {
+			select {
+			case <-c.drained:
+			case <-c.closed:
+				return written, net.ErrClosed
+			}
+		}
+		chunk := b
+		if len(chunk) > dataChannelChunk {
+			chunk = chunk[:dataChannelChunk]
+		}
+		n, err := c.rwc.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[len(chunk):]
+	}
+	return written, nil
+}
+
+// CloseWrite ends our side of the stream, the remote may still answer.
+func (c *dataChannelConn) CloseWrite() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.writeClosed {
+		return nil
+	}
+	c.writeClosed = true
+	_, err := c.rwc.Write(nil)
+	return err
+}
+
+func (c *dataChannelConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	err := c.rwc.Close()
+	if errors.Is(err, io.ErrClosedPipe) {
+		return nil
+	}
+	return err
+}
+
+func (c *dataChannelConn) LocalAddr() net.Addr  { return c.localAddr }
+func (c *dataChannelConn) RemoteAddr() net.Addr { return c.remoteAddr }
+
+func (c *dataChannelConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *dataChannelConn) SetReadDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	c.readDeadline = t
+	// wake up a pending read so it picks up the new deadline
+	close(c.deadlineSet)
+	c.deadlineSet = make(chan struct{})
+	return nil
+}
+
+// SetWriteDeadline is a no-op, writes only block on the send buffer.
+func (c *dataChannelConn) SetWriteDeadline(time.Time) error { return nil }
+
+func stopTimer(t *time.Timer) {
+	if t != nil {
+		t.Stop()
+	}
+}
@@ -0,0 +1,164 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// newWebRTCPair connects two in-process PeerConnections over host candidates.
+func newWebRTCPair(t *testing.T) (*webrtcTransport, *webrtcTransport) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	a, err := newWebRTCTransport(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = a.Close() })
+	b, err := newWebRTCTransport(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = b.Close() })
+
+	offer, err := a.offer(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = b.pc.SetRemoteDescription(*offer); err != nil {
+		t.Fatal(err)
+	}
+	answer, err := b.pc.CreateAnswer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc, err := b.setLocalDescription(ctx, answer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = a.pc.SetRemoteDescription(*desc); err != nil {
+		t.Fatal(err)
+	}
+	for _, tr := range []*webrtcTransport{a, b} {
+		if err = tr.waitConnected(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return a, b
+}
+
+func TestWebRTCStreamHalfClose(t *testing.T) {
+	a, b := newWebRTCPair(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	accepted := make(chan error, 1)
+	go func() {
+		conn, err := b.AcceptStream(ctx)
+		if err != nil {
+			accepted <- err
+			return
+		}
+		defer conn.Close()
+		// read the whole request, the EOF marker included, then answer
+		req, err := io.ReadAll(conn)
+		if err != nil {
+			accepted <- err
+			return
+		}
+		if _, err = conn.Write(append([]byte("re: "), req...)); err != nil {
+			accepted <- err
+			return
+		}
+		accepted <- conn.(closeWriter).CloseWrite()
+	}()
+
+	conn, err := a.OpenStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	big := make([]byte, 3*dataChannelChunk+7)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	if _, err = conn.Write(big); err != nil {
+		t.Fatal(err)
+	}
+	if err = conn.(closeWriter).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Write([]byte("late")); err == nil {
+		t.Fatal("write after CloseWrite succeeded")
+	}
+	resp, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := append([]byte("re: "), big...); string(resp) != string(want) {
+		t.Fatalf("response of %d bytes, want %d", len(resp), len(want))
+	}
+	if err = <-accepted; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWebRTCDatagrams(t *testing.T) {
+	a, b := newWebRTCPair(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if a.MaxDatagramSize() != webrtcMaxDatagramSize {
+		t.Fatalf("max datagram size %d, want %d", a.MaxDatagramSize(), webrtcMaxDatagramSize)
+	}
+	if err := a.SendDatagram(make([]byte, webrtcMaxDatagramSize+1)); !errors.Is(err, ErrDatagramTooLarge) {
+		t.Fatalf("oversized datagram error %v, want %v", err, ErrDatagramTooLarge)
+	}
+	// unreliable, so send until one arrives
+	want := make([]byte, webrtcMaxDatagramSize)
+	copy(want, "hello")
+	go func() {
+		for ctx.Err() == nil {
+			_ = a.SendDatagram(want)
+			time.Sleep(50 * time.Millisecond)
+		}
+	}()
+	got, err := b.ReceiveDatagram(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(want) {
+		t.Fatalf("got datagram of %d bytes, want %d", len(got), len(want))
+	}
+}
+
+func TestWebRTCPeer(t *testing.T) {
+	a, b := newWebRTCPair(t)
+	pa := newHTTP2Peer(context.Background(), a)
+	pb := newHTTP2Peer(context.Background(), b)
+	defer pa.Close()
+	defer pb.Close()
+	for _, p := range []*Peer{pa, pb} {
+		p.HandleFunc("/hello", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "hello")
+		})
+	}
+	for i, p := range []*Peer{pa, pb} {
+		resp, err := p.Client.Get("https://tunnel/hello")
+		if err != nil {
+			t.Fatalf("peer %d: %s", i, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if string(body) != "hello" {
+			t.Fatalf("body %q", body)
+		}
+	}
+}
@@ -0,0 +1,406 @@
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSockets over HTTP/2 use extended CONNECT (RFC 8441): a CONNECT request
+// with the :protocol pseudo header "websocket", whose request and response
+// bodies carry the frames. golang.org/x/net/http2 servers only accept them
+// with GODEBUG=http2xconnect=1 in the environment of the serving process.
+
+// websocketGUID is appended to the key of a WebSocket handshake, RFC 6455.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var errWebSocketUnsupported = errors.New("websockets need an HTTP/2 peer")
+
+// ErrExtendedConnectDisabled is returned by WebSocketDialer's dials when the
+// remote does not accept extended CONNECT, it has to run with
+// GODEBUG=http2xconnect=1.
+var ErrExtendedConnectDisabled = errors.New("websockets need GODEBUG=http2xconnect=1 on the remote")
+
+// errExtendedConnectNotSupported is the text of the unexported error
+// golang.org/x/net/http2 fails extended CONNECT requests with, when the
+// remote did not announce SETTINGS_ENABLE_CONNECT_PROTOCOL.
+const errExtendedConnectNotSupported = "net/http: extended connect not supported by peer"
+
+// extendedConnectEnabled reports whether our HTTP/2 server accepts extended
+// CONNECT, golang.org/x/net/http2 decides it from GODEBUG at init.
+func extendedConnectEnabled() bool {
+	return strings.Contains(os.Getenv("GODEBUG"), "http2xconnect=1")
+}
+
+// WebSocketDialer returns a gorilla/websocket Dialer whose connections are
+// extended CONNECT requests to the remote, e.g.
+//
+//	conn, _, err := peer.WebSocketDialer().Dial("ws://tunnel/live", nil)
+//
+// The remote serves them with UpgradeWebSocket or Expose, and has to run
+// with GODEBUG=http2xconnect=1, otherwise dials fail with
+// ErrExtendedConnectDisabled. Not available with HTTP/3.
+func (p *Peer) WebSocketDialer() *websocket.Dialer {
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if p.h2conns == nil {
+			return nil, errWebSocketUnsupported
+		}
+		return &websocketDialConn{p: p, ctx: ctx, addr: p.tr.RemoteAddr(), local: p.tr.LocalAddr()}, nil
+	}
+	return &websocket.Dialer{
+		NetDialContext:    dial,
+		NetDialTLSContext: dial,
+		HandshakeTimeout:  forwardTimeout,
+	}
+}
+
+// UpgradeWebSocket upgrades a request to a WebSocket with u, like
+// u.Upgrade, for extended CONNECT requests too.
+func UpgradeWebSocket(w http.ResponseWriter, r *http.Request, u *websocket.Upgrader, responseHeader http.Header) (*websocket.Conn, error) {
+	if r.Method != http.MethodConnect || !strings.EqualFold(r.Header.Get(":protocol"), "websocket") {
+		return u.Upgrade(w, r, responseHeader)
+	}
+	// present the request as the HTTP/1.1 upgrade gorilla expects and
+	// answer its 101 with a 200 on the stream
+	key := websocketKey()
+	h1 := r.Clone(r.Context())
+	h1.Method = http.MethodGet
+	h1.Proto, h1.ProtoMajor, h1.ProtoMinor = "HTTP/1.1", 1, 1
+	h1.Header.Del(":protocol")
+	h1.Header.Set("Connection", "Upgrade")
+	h1.Header.Set("Upgrade", "websocket")
+	h1.Header.Set("Sec-WebSocket-Key", key)
+	conn := &bodyConn{
+		r:     r.Body,
+		w:     w,
+		flush: http.NewResponseController(w).Flush,
+		local: localAddr(r),
+		addr:  remoteAddr(r),
+	}
+	conn.handshake = func(b []byte) ([]byte, error) {
+		resp, rest, err := readHandshake(b, http.MethodGet)
+		if err != nil {
+			return nil, err
+		}
+		for k, vv := range resp.Header {
+			switch k {
+			case "Connection", "Upgrade", "Sec-Websocket-Accept":
+			default:
+				w.Header()[k] = vv
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+		return rest, nil
+	}
+	return u.Upgrade(&hijackWriter{ResponseWriter: w, conn: conn}, h1, responseHeader)
+}
+
+// hijackWriter hands conn to an Upgrader as the hijacked connection.
+type hijackWriter struct {
+	http.ResponseWriter
+	conn net.Conn
+}
+
+func (w *hijackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.conn, bufio.NewReadWriter(bufio.NewReader(w.conn), bufio.NewWriter(w.conn)), nil
+}
+
+// bodyConn is a net.Conn over the bodies of an extended CONNECT request.
+// Deadlines are final: once one passes the connection is closed.
+type bodyConn struct {
+	r     io.ReadCloser
+	w     io.Writer
+	flush func() error
+	close func() error
+
+	// handshake, if set, gets the first write, the HTTP/1.1 handshake of
+	// gorilla, and returns the bytes after it
+	handshake func([]byte) ([]byte, error)
+
+	local, addr net.Addr
+
+	mu        sync.Mutex
+	closed    bool
+	readTimer *time.Timer
+	writeTime *time.Timer
+}
+
+func (c *bodyConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+func (c *bodyConn) Write(b []byte) (int, error) {
+	n := len(b)
+	if c.handshake != nil {
+		rest, err := c.handshake(b)
+		c.handshake = nil
+		if err != nil {
+			return 0, err
+		}
+		b = rest
+	}
+	if len(b) > 0 {
+		if _, err := c.w.Write(b); err != nil {
+			return 0, err
+		}
+	}
+	if c.flush != nil {
+		if err := c.flush(); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+func (c *bodyConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	for _, t := range []*time.Timer{c.readTimer, c.writeTime} {
+		if t != nil {
+			t.Stop()
+		}
+	}
+	c.mu.Unlock()
+	err := c.r.Close()
+	if c.close != nil {
+		err = errors.Join(err, c.close())
+	}
+	return err
+}
+
+func (c *bodyConn) LocalAddr() net.Addr  { return c.local }
+func (c *bodyConn) RemoteAddr() net.Addr { return c.addr }
+
+func (c *bodyConn) SetDeadline(t time.Time) error {
+	_ = c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *bodyConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readTimer = c.deadline(c.readTimer, t)
+	return nil
+}
+
+func (c *bodyConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeTime = c.deadline(c.writeTime, t)
+	return nil
+}
+
+// deadline replaces timer with one closing c at t, none for a zero t.
+func (c *bodyConn) deadline(timer *time.Timer, t time.Time) *time.Timer {
+	if timer != nil {
+		timer.Stop()
+	}
+	if t.IsZero() || c.closed {
+		return nil
+	}
+	return time.AfterFunc(time.Until(t), func() { _ = c.Close() })
+}
+
+// websocketDialConn turns the HTTP/1.1 handshake gorilla writes into an
+// extended CONNECT request and answers it with the 101 gorilla expects.
+// The dial ctx and the deadlines set before the stream exists bound the
+// request, the stream outlives them.
+type websocketDialConn struct {
+	p           *Peer
+	ctx         context.Context
+	local, addr net.Addr
+
+	req  []byte // handshake request written so far
+	resp []byte // handshake response not read yet
+	conn *bodyConn
+
+	// deadlines set before conn exists
+	readDeadline, writeDeadline time.Time
+}
+
+func (c *websocketDialConn) Write(b []byte) (int, error) {
+	if c.conn != nil {
+		return c.conn.Write(b)
+	}
+	c.req = append(c.req, b...)
+	if !bytes.Contains(c.req, []byte("\r\n\r\n")) {
+		return len(b), nil
+	}
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(c.req)))
+	if err != nil {
+		return 0, err
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	ctx, cancel := context.WithCancel(context.Background())
+	stop := context.AfterFunc(c.ctx, cancel)
+	defer stop()
+	if deadline := earliest(c.readDeadline, c.writeDeadline); !deadline.IsZero() {
+		timer := time.AfterFunc(time.Until(deadline), cancel)
+		defer timer.Stop()
+	}
+	pr, pw := io.Pipe()
+	out, err := http.NewRequestWithContext(ctx, http.MethodConnect, "https://tunnel"+req.URL.RequestURI(), pr)
+	if err != nil {
+		cancel()
+		return 0, err
+	}
+	for k, vv := range req.Header {
+		switch k {
+		case "Connection", "Upgrade", "Sec-Websocket-Key":
+		default:
+			out.Header[k] = vv
+		}
+	}
+	out.Header.Set(":protocol", "websocket")
+	resp, err := c.p.Client.Transport.RoundTrip(out)
+	if err != nil {
+		expired := ctx.Err() != nil
+		cancel()
+		_ = pw.Close()
+		if c.ctx.Err() != nil {
+			return 0, c.ctx.Err()
+		}
+		if expired {
+			return 0, os.ErrDeadlineExceeded
+		}
+		if err.Error() == errExtendedConnectNotSupported {
+			return 0, ErrExtendedConnectDisabled
+		}
+		return 0, err
+	}
+
+	var h bytes.Buffer
+	if resp.StatusCode == http.StatusOK {
+		h.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+		h.WriteString("Sec-WebSocket-Accept: " + websocketAccept(key) + "\r\n")
+		_ = resp.Header.Write(&h)
+		h.WriteString("\r\n")
+		c.resp = h.Bytes()
+		c.conn = &bodyConn{
+			r: resp.Body,
+			w: pw,
+			close: func() error {
+				cancel()
+				return pw.Close()
+			},
+			local: c.local,
+			addr:  c.addr,
+		}
+		_ = c.conn.SetReadDeadline(c.readDeadline)
+		_ = c.conn.SetWriteDeadline(c.writeDeadline)
+		return len(b), nil
+	}
+	// refused, gorilla reports the response with ErrBadHandshake
+	defer cancel()
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	_ = pw.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Proto, resp.ProtoMajor, resp.ProtoMinor = "HTTP/1.1", 1, 1
+	_ = resp.Write(&h)
+	c.resp = h.Bytes()
+	return len(b), nil
+}
+
+func (c *websocketDialConn) Read(b []byte) (int, error) {
+	if len(c.resp) > 0 {
+		n := copy(b, c.resp)
+		c.resp = c.resp[n:]
+		return n, nil
+	}
+	if c.conn == nil {
+		return 0, io.EOF
+	}
+	return c.conn.Read(b)
+}
+
+func (c *websocketDialConn) Close() error {
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.Close()
+}
+
+func (c *websocketDialConn) LocalAddr() net.Addr  { return c.local }
+func (c *websocketDialConn) RemoteAddr() net.Addr { return c.addr }
+
+func (c *websocketDialConn) SetDeadline(t time.Time) error {
+	_ = c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *websocketDialConn) SetReadDeadline(t time.Time) error {
+	if c.conn == nil {
+		c.readDeadline = t
+		return nil
+	}
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *websocketDialConn) SetWriteDeadline(t time.Time) error {
+	if c.conn == nil {
+		c.writeDeadline = t
+		return nil
+	}
+	return c.conn.SetWriteDeadline(t)
+}
+
+// earliest returns the earlier of two deadlines, zero meaning none.
+func earliest(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+	return a
+}
+
+// readHandshake parses the HTTP/1.1 response at the start of b and returns
+// the bytes after it.
+func readHandshake(b []byte, method string) (*http.Response, []byte, error) {
+	end := bytes.Index(b, []byte("\r\n\r\n"))
+	if end < 0 {
+		return nil, nil, fmt.Errorf("incomplete websocket handshake")
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(b[:end+4])), &http.Request{Method: method})
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, b[end+4:], nil
+}
+
+func websocketKey() string {
+	key := make([]byte, 16)
+	_, _ = rand.Read(key)
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func websocketAccept(key string) string {
+	h := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+func localAddr(r *http.Request) net.Addr {
+	addr, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return addr
+}
+
+func remoteAddr(r *http.Request) net.Addr {
+	addr, _ := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	return addr
+}
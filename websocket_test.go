@@ -0,0 +1,130 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestWebSocket covers UpgradeWebSocket and Expose. It runs itself again
+// with GODEBUG=http2xconnect=1 if needed, golang.org/x/net/http2 reads it
+// once at init.
+func TestWebSocket(t *testing.T) {
+	if !strings.Contains(os.Getenv("GODEBUG"), "http2xconnect=1") {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestWebSocket$", "-test.v")
+		cmd.Env = append(os.Environ(), "GODEBUG=http2xconnect=1")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("%s\n%s", err, out)
+		}
+		return
+	}
+	a, b := newPeerPair(t)
+	echo := func(w http.ResponseWriter, r *http.Request) {
+		conn, err := UpgradeWebSocket(w, r, &websocket.Upgrader{}, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			typ, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err = conn.WriteMessage(typ, msg); err != nil {
+				return
+			}
+		}
+	}
+	b.HandleFunc("/echo", echo)
+	upstream := httptest.NewServer(http.HandlerFunc(echo))
+	defer upstream.Close()
+	if err := b.Expose("/app", upstream.URL); err != nil {
+		t.Fatal(err)
+	}
+	b.HandleFunc("/stuck", func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})
+
+	for _, url := range []string{"ws://tunnel/echo", "ws://tunnel/app/echo"} {
+		t.Run(url, func(t *testing.T) {
+			conn, _, err := a.WebSocketDialer().Dial(url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			for _, msg := range []string{"hello", "world"} {
+				if err = conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+					t.Fatal(err)
+				}
+				_, got, err := conn.ReadMessage()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != msg {
+					t.Fatalf("got %q, want %q", got, msg)
+				}
+			}
+		})
+	}
+
+	t.Run("handshake timeout", func(t *testing.T) {
+		d := a.WebSocketDialer()
+		d.HandshakeTimeout = 100 * time.Millisecond
+		start := time.Now()
+		if _, _, err := d.Dial("ws://tunnel/stuck", nil); err == nil {
+			t.Fatal("dial succeeded")
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Fatalf("dial returned after %s", elapsed)
+		}
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		d := a.WebSocketDialer()
+		d.HandshakeTimeout = 0
+		if _, _, err := d.DialContext(ctx, "ws://tunnel/stuck", nil); err == nil {
+			t.Fatal("dial succeeded")
+		}
+		// gorilla also sets the context's deadline on the connection, which
+		// may expire first
+		if deadline, _ := ctx.Deadline(); time.Now().Before(deadline) {
+			t.Fatal("dial returned before the context ended")
+		}
+	})
+}
+
+// TestWebSocketExtendedConnectDisabled runs without GODEBUG=http2xconnect=1,
+// dials fail with a clear error and Expose warns.
+func TestWebSocketExtendedConnectDisabled(t *testing.T) {
+	if extendedConnectEnabled() {
+		t.Skip("extended CONNECT enabled")
+	}
+	a, b := newPeerPair(t)
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stdout)
+	if err := b.Expose("/app", "http://localhost:3000"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logged.String(), "http2xconnect=1") {
+		t.Fatalf("expose logged %q", logged.String())
+	}
+
+	for _, url := range []string{"ws://tunnel/echo", "ws://tunnel/app/echo"} {
+		if _, _, err := a.WebSocketDialer().Dial(url, nil); !errors.Is(err, ErrExtendedConnectDisabled) {
+			t.Fatalf("dial %s: %v, want %v", url, err, ErrExtendedConnectDisabled)
+		}
+	}
+}